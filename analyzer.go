@@ -0,0 +1,131 @@
+package errfix
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+// Analyzer reports every rewrite of errfix as a diagnostic, with a suggested fix that applies it.
+// It runs with the configuration of the .errfix.yaml files of the package directories, and its flags override them.
+// It can be run by go vet -vettool, singlechecker, gopls or golangci-lint.
+var Analyzer = newAnalyzer()
+
+type analyzer struct {
+	*analysis.Analyzer
+	mode         string
+	rules        string
+	types        bool
+	errName      string
+	stdSentinels bool
+	ruleFiles    string
+	messageStyle string
+
+	once sync.Once
+	p    *configProcessor
+}
+
+func newAnalyzer() *analysis.Analyzer {
+	a := &analyzer{}
+	a.Analyzer = &analysis.Analyzer{
+		Name: "errfix",
+		Doc:  "report errors that errfix would rewrite\n\nThe suggested fixes wrap returned errors with github.com/pkg/errors, or convert them to the standard library, as configured by " + ConfigFileName + ".",
+		Run:  a.run,
+	}
+	a.Flags.StringVar(&a.mode, "mode", "", "rewrite toward github.com/pkg/errors (pkg) or the standard library (std)")
+	a.Flags.StringVar(&a.rules, "rules", "", "comma-separated names of the rules to run instead of the rules of the mode")
+	a.Flags.BoolVar(&a.types, "types", false, "detect errors by their type instead of the name err")
+	a.Flags.StringVar(&a.errName, "errname", "", "regular expression that names of error variables must match")
+	a.Flags.BoolVar(&a.stdSentinels, "std-sentinels", false, "rewrite package-level fmt.Errorf sentinels without arguments to errors.New of the standard library")
+	a.Flags.StringVar(&a.ruleFiles, "rule-files", "", "comma-separated files of pattern rules to run after the rules of the mode")
+	a.Flags.StringVar(&a.messageStyle, "message-style", "", "style of the messages of rewritten errors, keep or lower")
+	return a.Analyzer
+}
+
+// override gives precedence to the flags that are set over the configuration files.
+func (a *analyzer) override(c *Config) {
+	a.Flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mode":
+			c.Mode = a.mode
+		case "rules":
+			c.Rules = SplitList(a.rules)
+		case "types":
+			c.Types = a.types
+		case "errname":
+			c.ErrName = a.errName
+		case "std-sentinels":
+			c.StdSentinels = a.stdSentinels
+		case "rule-files":
+			c.RuleFiles = nil
+			for _, name := range SplitList(a.ruleFiles) {
+				if abs, err := filepath.Abs(name); err == nil {
+					name = abs
+				}
+				c.RuleFiles = append(c.RuleFiles, name)
+			}
+		case "message-style":
+			c.MessageStyle = a.messageStyle
+		}
+	})
+}
+
+func (a *analyzer) run(pass *analysis.Pass) (interface{}, error) {
+	// The flags are parsed after the analyzer is created, so the processor is created on first use.
+	a.once.Do(func() {
+		a.p = newConfigProcessor(a.override)
+	})
+
+	for _, af := range pass.Files {
+		tf := pass.Fset.File(af.Pos())
+		if tf == nil {
+			continue
+		}
+		name := tf.Name()
+		content, err := os.ReadFile(name)
+		// Files that do not match their syntax tree, such as the sources of cgo, are skipped.
+		if err != nil || len(content) != tf.Size() {
+			continue
+		}
+		c, p, err := a.p.lookup(filepath.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		if c.Excluded(name) {
+			continue
+		}
+		f, err := p.processAST(context.Background(), &File{Name: name, Content: string(content)}, pass.Fset, af, pass.TypesInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		fixes, rest := splitFixes(string(content), f.Content, f.Edits)
+		if len(rest) > 0 {
+			// Edits that no rewrite needs are still reported, so that applying all fixes gives the whole rewrite.
+			fixes = append(fixes, rest)
+		}
+		for _, fix := range fixes {
+			e := fix[0]
+			msg := e.Message
+			if e.Rule != "" {
+				msg += " (" + e.Rule + ")"
+			}
+			var edits []analysis.TextEdit
+			for _, fe := range fix {
+				edits = append(edits, analysis.TextEdit{Pos: tf.Pos(fe.Pos.Offset), End: tf.Pos(fe.End.Offset), NewText: []byte(fe.NewText)})
+			}
+			pass.Report(analysis.Diagnostic{
+				Pos:            tf.Pos(e.Pos.Offset),
+				End:            tf.Pos(e.End.Offset),
+				Category:       e.Rule,
+				Message:        msg,
+				SuggestedFixes: []analysis.SuggestedFix{{Message: msg, TextEdits: edits}},
+			})
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,199 @@
+package errfix
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dave/dst"
+)
+
+// Baseline holds the rewrites accepted in the existing code, so that only new code is flagged.
+// A rewrite is identified by its file, the function that contains it, its rule and its code, not by its line,
+// so that the baseline still applies after the code around it moves.
+type Baseline struct {
+	mu sync.Mutex
+	// counts maps the keys of the rewrites to their number, since the same code may appear several times in a function.
+	counts map[baselineKey]int
+}
+
+type baselineKey struct {
+	// file is the absolute path of the file.
+	file     string
+	function string
+	rule     string
+	code     string
+}
+
+// BaselineEntry is an entry of a baseline file, as written by Baseline.Save.
+type BaselineEntry struct {
+	// File is the slash-separated path of the file, relative to the directory of the baseline file.
+	File string `json:"file"`
+	// Function is the name of the function that contains the rewrite, such as Store.Get, or empty at package level.
+	Function string `json:"function"`
+	Rule     string `json:"rule"`
+	// Code is the rewritten code with its spaces collapsed.
+	Code  string `json:"code"`
+	Count int    `json:"count"`
+}
+
+// NewBaseline returns an empty Baseline, to be filled by a Processor with WithBaselineRecord.
+func NewBaseline() *Baseline {
+	return &Baseline{counts: map[baselineKey]int{}}
+}
+
+// LoadBaseline reads a baseline file written by Baseline.Save.
+func LoadBaseline(name string) (*Baseline, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading baseline, %v", err)
+	}
+	var entries []BaselineEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing baseline %s, %v", name, err)
+	}
+	dir, err := filepath.Abs(filepath.Dir(name))
+	if err != nil {
+		return nil, fmt.Errorf("error resolving directory of baseline %s, %v", name, err)
+	}
+	b := NewBaseline()
+	for _, e := range entries {
+		k := baselineKey{file: filepath.Join(dir, filepath.FromSlash(e.File)), function: e.Function, rule: e.Rule, code: e.Code}
+		b.counts[k] += e.Count
+	}
+	return b, nil
+}
+
+// Entries returns the entries of the baseline, ordered by file, function, rule and code,
+// with paths relative to the directory dir.
+func (b *Baseline) Entries(dir string) []BaselineEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dir, _ = filepath.Abs(dir)
+	entries := make([]BaselineEntry, 0, len(b.counts))
+	for k, n := range b.counts {
+		file := k.file
+		if rel, err := filepath.Rel(dir, file); err == nil {
+			file = rel
+		}
+		entries = append(entries, BaselineEntry{File: filepath.ToSlash(file), Function: k.function, Rule: k.rule, Code: k.code, Count: n})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Function != b.Function {
+			return a.Function < b.Function
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		return a.Code < b.Code
+	})
+	return entries
+}
+
+// Save writes the baseline to the file name as JSON.
+func (b *Baseline) Save(name string) error {
+	data, err := json.MarshalIndent(b.Entries(filepath.Dir(name)), "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding baseline, %v", err)
+	}
+	err = os.WriteFile(name, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing baseline, %v", err)
+	}
+	return nil
+}
+
+func (b *Baseline) add(k baselineKey) {
+	b.mu.Lock()
+	b.counts[k]++
+	b.mu.Unlock()
+}
+
+func (b *Baseline) count(k baselineKey) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.counts[k]
+}
+
+// WithBaseline leaves unchanged the rewrites recorded in the baseline, so that only new rewrites are made and reported.
+// When the same code appears more often in a function than recorded, the first occurrences are left unchanged.
+func WithBaseline(b *Baseline) ProcessorOption {
+	return func(p *processor) {
+		p.baseline = b
+	}
+}
+
+// WithBaselineRecord records the rewrites of all processed files in the baseline, to be saved with Baseline.Save.
+func WithBaselineRecord(b *Baseline) ProcessorOption {
+	return func(p *processor) {
+		p.baselineRecord = b
+	}
+}
+
+// inBaseline returns true when the rewrite of key k is accepted by the baseline, which uses up one of its occurrences.
+// The accepted rewrites are recorded as well when the baseline is being written, so that they stay accepted.
+func (ps *Pass) inBaseline(k baselineKey) bool {
+	if ps.baseline == nil || ps.baselineUsed[k] >= ps.baseline.count(k) {
+		return false
+	}
+	ps.baselineUsed[k]++
+	if ps.baselineRecord != nil {
+		ps.baselineRecord.add(k)
+	}
+	return true
+}
+
+// baselineKey returns the key of the rewrite of n by the running rule.
+func (ps *Pass) baselineKey(n dst.Node) baselineKey {
+	k := baselineKey{file: ps.fileName, rule: ps.rule}
+	an, ok := ps.dec.Ast.Nodes[headerNode(n)]
+	if !ok {
+		return k
+	}
+	tf := ps.dec.Fset.File(an.Pos())
+	if tf != nil && tf.Size() == len(ps.content) {
+		k.code = strings.Join(strings.Fields(ps.content[tf.Offset(an.Pos()):tf.Offset(an.End())]), " ")
+	}
+	for _, d := range ps.file.Decls {
+		fd, ok := ps.dec.Ast.Nodes[d].(*ast.FuncDecl)
+		if !ok || an.Pos() < fd.Pos() || an.End() > fd.End() {
+			continue
+		}
+		k.function = fd.Name.Name
+		if fd.Recv != nil && len(fd.Recv.List) > 0 {
+			k.function = recvTypeName(fd.Recv.List[0].Type) + "." + k.function
+		}
+		break
+	}
+	return k
+}
+
+// recvTypeName returns the name of the type of a receiver, without pointer and type parameters.
+func recvTypeName(e ast.Expr) string {
+	for {
+		switch t := e.(type) {
+		case *ast.StarExpr:
+			e = t.X
+		case *ast.ParenExpr:
+			e = t.X
+		case *ast.IndexExpr:
+			e = t.X
+		case *ast.IndexListExpr:
+			e = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
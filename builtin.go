@@ -0,0 +1,804 @@
+package errfix
+
+import (
+	"context"
+	"fmt"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+// Names of the built-in rules.
+const (
+	ruleWithStack = "withstack"
+	ruleCause     = "cause"
+	ruleWrapf     = "wrapf"
+	ruleErrorfW   = "errorf-w"
+	ruleIs        = "is"
+	ruleAs        = "as"
+)
+
+func init() {
+	RegisterRule(newWithStackRule)
+	RegisterRule(newCauseRule)
+	RegisterRule(newWrapfRule)
+	RegisterRule(newErrorfWRule)
+	RegisterRule(newIsRule)
+	RegisterRule(newAsRule)
+}
+
+// modeRuleNames lists the built-in rules of every mode in the order they run.
+// The withstack rule runs before the cause rule, which rewrites the comparisons it looks at.
+var modeRuleNames = map[Mode][]string{
+	ModePkgErrors: {ruleWithStack, ruleCause, ruleWrapf},
+	ModeStdErrors: {ruleErrorfW, ruleIs, ruleAs},
+}
+
+// modeRules returns the built-in rules of the mode.
+func modeRules(m Mode) []NewRuleFunc {
+	var rules []NewRuleFunc
+	for _, name := range modeRuleNames[m] {
+		newRule, err := LookupRule(name)
+		if err != nil {
+			panic(err)
+		}
+		rules = append(rules, newRule)
+	}
+	return rules
+}
+
+const pkgErrorsPath = "github.com/pkg/errors"
+
+// usePkgErrors makes the file import github.com/pkg/errors, replacing the import of the errors package
+// of the standard library if any, and returns the name of the package in the file.
+func usePkgErrors(f *dst.File) string {
+	imports := getImports(f)
+	if imp := findImportByPath(imports, pkgErrorsPath); imp != nil {
+		return importName(imp)
+	}
+	// The name of the replaced import is kept, as the code of the file refers to it.
+	if imp := findImportByPath(imports, "errors"); imp != nil {
+		imp.Path.Value = strconv.Quote(pkgErrorsPath)
+		return importName(imp)
+	}
+	return addFreeImport(f, pkgErrorsPath, "errors", "pkgerrors", imports)
+}
+
+// useStdErrors makes the file import the errors package of the standard library, unless github.com/pkg/errors
+// is imported, which also provides Is and As, and returns the name of the imported package in the file.
+func useStdErrors(f *dst.File) string {
+	imports := getImports(f)
+	if imp := findImportByPath(imports, "errors"); imp != nil {
+		return importName(imp)
+	}
+	if imp := findImportByPath(imports, pkgErrorsPath); imp != nil {
+		return importName(imp)
+	}
+	return addFreeImport(f, "errors", "errors", "stderrors", imports)
+}
+
+// addFreeImport imports ipath as name, or as alt when another import takes name, and returns the name it got.
+func addFreeImport(f *dst.File, ipath, name, alt string, imports []*dst.GenDecl) string {
+	for _, imp := range imports {
+		for _, spec := range imp.Specs {
+			if importName(spec.(*dst.ImportSpec)) == name {
+				addImport(f, ipath, alt, imports)
+				return alt
+			}
+		}
+	}
+	if path.Base(ipath) == name {
+		addImport(f, ipath, "", imports)
+	} else {
+		addImport(f, ipath, name, imports)
+	}
+	return name
+}
+
+// errorsSelectors holds the selectors of the errors package that a rule emits, such as errors.WithStack.
+// The name of the package is known once the rule has made the file import it, which may be under an alias,
+// so they are renamed then.
+type errorsSelectors struct {
+	sels []*dst.SelectorExpr
+}
+
+// selector returns the selector of sel in the errors package, named x until rename is called.
+func (s *errorsSelectors) selector(x, sel string) *dst.SelectorExpr {
+	e := &dst.SelectorExpr{X: dst.NewIdent(x), Sel: dst.NewIdent(sel)}
+	s.sels = append(s.sels, e)
+	return e
+}
+
+// rename makes the selectors refer to the errors package imported as name.
+func (s *errorsSelectors) rename(name string) {
+	for _, e := range s.sels {
+		e.X = dst.NewIdent(name)
+	}
+}
+
+// causeExpr returns errors.Cause(x).
+func (s *errorsSelectors) causeExpr(x dst.Expr) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun:  s.selector("errors", "Cause"),
+		Args: []dst.Expr{x},
+	}
+}
+
+type withStackRule struct {
+	errorsSelectors
+	errorsIdent    string
+	withStackIdent string
+	contracts      map[*dst.ReturnStmt]string
+	changed        bool
+}
+
+func newWithStackRule() Rule {
+	return &withStackRule{
+		errorsIdent:    "errors",
+		withStackIdent: "WithStack",
+		contracts:      map[*dst.ReturnStmt]string{},
+	}
+}
+
+func (r *withStackRule) Name() string {
+	return ruleWithStack
+}
+
+func (r *withStackRule) Description() string {
+	return "wrap returned errors with errors.WithStack"
+}
+
+func (r *withStackRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	switch n := n.(type) {
+	case *dst.FuncDecl:
+		r.findContractReturns(p, n.Name.Name, n.Recv != nil, n.Type, n.Body)
+	case *dst.FuncLit:
+		r.findContractReturns(p, "", false, n.Type, n.Body)
+	case *dst.SwitchStmt:
+		r.findSentinelSwitchReturns(p, n)
+	case *dst.IfStmt:
+		r.findSentinelIfReturns(p, n)
+	case *dst.ReturnStmt:
+		r.changed = r.fixReturnStmt(p, n) || r.changed
+	}
+	return nil
+}
+
+func (r *withStackRule) EndProcess(ctx context.Context, p *Pass, f *dst.File) (bool, error) {
+	if r.changed {
+		r.rename(usePkgErrors(f))
+	}
+	return r.changed, nil
+}
+
+func (r *withStackRule) fixReturnStmt(p *Pass, n *dst.ReturnStmt) (changed bool) {
+	// return [..., ]err
+	// ->
+	// return [..., ]errors.WithStack(err)
+	if len(n.Results) == 0 {
+		return
+	}
+	lastResult := &n.Results[len(n.Results)-1]
+	if !p.IsErr(*lastResult) {
+		return
+	}
+	if reason, ok := r.contracts[n]; ok {
+		p.Note(n, "return left unwrapped: "+reason)
+		return
+	}
+	if p.Ignored(n) {
+		return
+	}
+	*lastResult = &dst.CallExpr{
+		Fun:  r.selector(r.errorsIdent, r.withStackIdent),
+		Args: []dst.Expr{*lastResult},
+	}
+	p.Rewrote(n)
+	return true
+}
+
+type causeRule struct {
+	errorsSelectors
+	nilIdent string
+	changed  bool
+}
+
+func newCauseRule() Rule {
+	return &causeRule{nilIdent: "nil"}
+}
+
+func (r *causeRule) Name() string {
+	return ruleCause
+}
+
+func (r *causeRule) Description() string {
+	return "compare errors and assert their types through errors.Cause"
+}
+
+func (r *causeRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	changed := false
+	switch n := n.(type) {
+	case *dst.IfStmt:
+		changed = r.fixIfStmt(p, n)
+	case *dst.SwitchStmt:
+		changed = r.fixSwitchStmt(p, n)
+	case *dst.TypeAssertExpr:
+		changed = r.fixTypeAssertExpr(p, n)
+	}
+	r.changed = r.changed || changed
+	return nil
+}
+
+func (r *causeRule) EndProcess(ctx context.Context, p *Pass, f *dst.File) (bool, error) {
+	if r.changed {
+		r.rename(usePkgErrors(f))
+	}
+	return r.changed, nil
+}
+
+func (r *causeRule) fixIfStmt(p *Pass, n *dst.IfStmt) (changed bool) {
+	cond, ok := n.Cond.(*dst.BinaryExpr)
+	if !ok {
+		return
+	}
+
+	// if stmt; err == something-but-not-nil
+	// ->
+	// if stmt; errors.Cause(err) == something-but-not-nil
+	if isErrCompare(cond, p.IsErr, r.nilIdent, false) {
+		if p.Ignored(n) {
+			return
+		}
+		cond.X = r.causeExpr(cond.X)
+		p.Rewrote(n)
+		return true
+	}
+	// if stmt; err != nil && err != something-but-not-nil
+	// ->
+	// if stmt; err != nil && errors.Cause(err) != something-but-not-nil
+	condX, okX := cond.X.(*dst.BinaryExpr)
+	condY, okY := cond.Y.(*dst.BinaryExpr)
+	ok = (cond.Op == token.LAND || cond.Op == token.LOR) &&
+		(okX && isErrCompare(condX, p.IsErr, r.nilIdent, true)) &&
+		(okY && isErrCompare(condY, p.IsErr, r.nilIdent, false))
+	if ok && !p.Ignored(n) {
+		condY.X = r.causeExpr(condY.X)
+		p.Rewrote(n)
+		return true
+	}
+
+	return
+}
+
+func (r *causeRule) fixTypeAssertExpr(p *Pass, n *dst.TypeAssertExpr) (changed bool) {
+	if !p.IsErr(n.X) || p.Ignored(n) {
+		return
+	}
+	n.X = r.causeExpr(n.X)
+	p.Rewrote(n)
+	return true
+}
+
+type wrapfRule struct {
+	errorsSelectors
+	errorsIdent    string
+	newIdent       string
+	errorfIdent    string
+	wrapfIdent     string
+	withStackIdent string
+	changed        bool
+	declChanged    bool
+}
+
+func newWrapfRule() Rule {
+	return &wrapfRule{
+		errorsIdent:    "errors",
+		newIdent:       "New",
+		errorfIdent:    "Errorf",
+		wrapfIdent:     "Wrapf",
+		withStackIdent: "WithStack",
+	}
+}
+
+func (r *wrapfRule) Name() string {
+	return ruleWrapf
+}
+
+func (r *wrapfRule) Description() string {
+	return "convert fmt.Errorf to errors.Wrapf or errors.Errorf, and errors.New to github.com/pkg/errors"
+}
+
+func (r *wrapfRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	call, ok := n.(*dst.CallExpr)
+	if !ok {
+		return nil
+	}
+	if p.IsTopLevel(call) {
+		r.declChanged = p.fixSentinelDecl(call) || r.declChanged
+	} else {
+		r.changed = r.fixCallExpr(p, call) || r.changed
+	}
+	return nil
+}
+
+func (r *wrapfRule) EndProcess(ctx context.Context, p *Pass, f *dst.File) (bool, error) {
+	if r.changed {
+		r.rename(usePkgErrors(f))
+	}
+	return r.changed || r.declChanged, nil
+}
+
+func (r *wrapfRule) fixCallExpr(p *Pass, n *dst.CallExpr) (changed bool) {
+	if isPkgSelector(n.Fun, r.errorsIdent, r.newIdent) {
+		// The call is rewritten when its message is restyled, or when the import of the standard library
+		// is switched to github.com/pkg/errors.
+		var lit *dst.BasicLit
+		styled := ""
+		if len(n.Args) == 1 {
+			if l, ok := n.Args[0].(*dst.BasicLit); ok && l.Kind == token.STRING {
+				if msg, err := strconv.Unquote(l.Value); err == nil && p.styleMessage(msg) != msg {
+					lit, styled = l, p.styleMessage(msg)
+				}
+			}
+		}
+		// The imports are those of the original file, as the rules that ran before may have switched them.
+		_, switched := p.imports[pkgErrorsPath]
+		switched = !switched
+		if lit == nil && !switched {
+			return
+		}
+		if p.Ignored(n) {
+			// The call keeps the errors package of the standard library, even if another rule switches the import.
+			if switched && p.imports["errors"] == r.errorsIdent {
+				p.stdNews = append(p.stdNews, n.Fun.(*dst.SelectorExpr))
+			}
+			return
+		}
+		if lit != nil {
+			lit.Value = strconv.Quote(styled)
+		}
+		p.Rewrote(n)
+		return true
+	}
+	if !isPkgSelector(n.Fun, "fmt", "Errorf") || len(n.Args) == 0 {
+		return
+	}
+	lit, ok := n.Args[0].(*dst.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return
+	}
+	format, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return
+	}
+	args := n.Args[1:]
+	verbs, reordered, ok := parseFormat(format, len(args))
+	if !ok {
+		p.Note(n, "fmt.Errorf left unchanged: the verbs of the format do not match the arguments")
+		return
+	}
+	errs := errorVerbs(p, verbs, args)
+	if len(errs) == 0 {
+		if p.Ignored(n) {
+			return
+		}
+		// fmt.Errorf("foo %s", x) ->
+		// errors.Errorf("foo %s", x)
+		if styled := p.styleMessage(format); styled != format {
+			lit.Value = quoteFormat(lit, styled)
+		}
+		n.Fun = r.selector(r.errorsIdent, r.errorfIdent)
+		p.Rewrote(n)
+		return true
+	}
+	// errors.Errorf formats with fmt.Sprintf, which neither wraps nor knows %w,
+	// so calls formatting errors become errors.Wrapf or are left unchanged.
+	e := errs[0]
+	prefix := format[:e.start]
+	message := strings.TrimRight(prefix, " :,")
+	reason := ""
+	switch {
+	case len(errs) > 1:
+		reason = "several errors are formatted, while errors.Wrapf wraps one"
+	case reordered:
+		reason = "errors.Wrapf cannot keep the argument indexes of the format"
+	case e != verbs[len(verbs)-1] || e.end != len(format):
+		reason = "the error is not at the end of the message, where errors.Wrapf puts it"
+	case !e.formatsMessage():
+		reason = fmt.Sprintf("the error is formatted with %s, unlike in the message of errors.Wrapf", format[e.start:e.end])
+	case message == prefix && prefix != "":
+		reason = "the error is not separated from the message by a colon, a comma or a space"
+	}
+	if reason != "" {
+		p.Note(n, "fmt.Errorf left unchanged: "+reason)
+		return
+	}
+	if p.Ignored(n) {
+		return
+	}
+	if message == "" {
+		// fmt.Errorf("%v", err) ->
+		// errors.WithStack(err)
+		n.Args = []dst.Expr{args[e.arg]}
+		n.Fun = r.selector(r.errorsIdent, r.withStackIdent)
+		p.Rewrote(n)
+		return true
+	}
+	// fmt.Errorf("format: %v", args..., err) ->
+	// errors.Wrapf(err, "format", args...)
+	newArgs := []dst.Expr{
+		args[e.arg],
+		&dst.BasicLit{
+			Kind:  token.STRING,
+			Value: quoteFormat(lit, p.styleMessage(message)),
+		},
+	}
+	newArgs = append(newArgs, args[:e.arg]...)
+	n.Args = newArgs
+	n.Fun = r.selector(r.errorsIdent, r.wrapfIdent)
+	p.Rewrote(n)
+	return true
+}
+
+type errorfWRule struct {
+	changed     bool
+	declChanged bool
+}
+
+func newErrorfWRule() Rule {
+	return &errorfWRule{}
+}
+
+func (r *errorfWRule) Name() string {
+	return ruleErrorfW
+}
+
+func (r *errorfWRule) Description() string {
+	return "wrap errors in fmt.Errorf with %w instead of %v or %s"
+}
+
+func (r *errorfWRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	call, ok := n.(*dst.CallExpr)
+	if !ok {
+		return nil
+	}
+	if p.IsTopLevel(call) {
+		r.declChanged = p.fixSentinelDecl(call) || r.declChanged
+	} else {
+		r.changed = r.fixCallExpr(p, call) || r.changed
+	}
+	return nil
+}
+
+func (r *errorfWRule) EndProcess(ctx context.Context, p *Pass, f *dst.File) (bool, error) {
+	// %w is handled by fmt, so no import is needed.
+	return r.changed || r.declChanged, nil
+}
+
+func (r *errorfWRule) fixCallExpr(p *Pass, n *dst.CallExpr) (changed bool) {
+	if !isPkgSelector(n.Fun, "fmt", "Errorf") || len(n.Args) < 2 {
+		return
+	}
+	lit, ok := n.Args[0].(*dst.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return
+	}
+	format, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return
+	}
+	args := n.Args[1:]
+	verbs, _, ok := parseFormat(format, len(args))
+	if !ok {
+		p.Note(n, "fmt.Errorf left unchanged: the verbs of the format do not match the arguments")
+		return
+	}
+	errs := errorVerbs(p, verbs, args)
+	for _, e := range errs {
+		if e.verb == 'w' {
+			return
+		}
+	}
+	if len(errs) == 0 {
+		return
+	}
+	e := errs[0]
+	switch {
+	case len(errs) > 1:
+		p.Note(n, "fmt.Errorf left unchanged: several errors are formatted, and %w can be used more than once only since Go 1.20")
+		return
+	case e.verb != 'v' && e.verb != 's':
+		p.Note(n, fmt.Sprintf("fmt.Errorf left unchanged: the error is formatted with %s, unlike with %%w", format[e.start:e.end]))
+		return
+	}
+	if p.Ignored(n) {
+		return
+	}
+	// fmt.Errorf("format %v: %s", err, arg) ->
+	// fmt.Errorf("format %w: %s", err, arg)
+	// The flags, width and precision of the verb apply to %w as well.
+	lit.Value = quoteFormat(lit, p.styleMessage(format[:e.end-1]+"w"+format[e.end:]))
+	p.Rewrote(n)
+	return true
+}
+
+type isRule struct {
+	errorsSelectors
+	errorsIdent string
+	isIdent     string
+	nilIdent    string
+	// cause makes the rule rewrite the switches on errors.Cause(err) instead of err.
+	cause   bool
+	changed bool
+}
+
+func newIsRule() Rule {
+	return &isRule{
+		errorsIdent: "errors",
+		isIdent:     "Is",
+		nilIdent:    "nil",
+	}
+}
+
+func (r *isRule) Name() string {
+	return ruleIs
+}
+
+func (r *isRule) Description() string {
+	return "compare errors with errors.Is instead of == and switch cases"
+}
+
+func (r *isRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	switch n := n.(type) {
+	case *dst.IfStmt:
+		r.changed = r.fixIfStmt(p, n) || r.changed
+	case *dst.SwitchStmt:
+		r.changed = r.fixSwitchStmt(p, n) || r.changed
+	}
+	return nil
+}
+
+func (r *isRule) EndProcess(ctx context.Context, p *Pass, f *dst.File) (bool, error) {
+	if r.changed {
+		r.rename(useStdErrors(f))
+	}
+	return r.changed, nil
+}
+
+func (r *isRule) fixIfStmt(p *Pass, n *dst.IfStmt) (changed bool) {
+	cond, ok := n.Cond.(*dst.BinaryExpr)
+	if !ok {
+		return
+	}
+
+	// if stmt; err == something-but-not-nil
+	// ->
+	// if stmt; errors.Is(err, something-but-not-nil)
+	if isErrCompare(cond, p.IsErr, r.nilIdent, false) {
+		if p.Ignored(n) {
+			return
+		}
+		n.Cond = r.isExpr(cond)
+		p.Rewrote(n)
+		return true
+	}
+	// if stmt; err != nil && err != something-but-not-nil
+	// ->
+	// if stmt; err != nil && !errors.Is(err, something-but-not-nil)
+	condX, okX := cond.X.(*dst.BinaryExpr)
+	condY, okY := cond.Y.(*dst.BinaryExpr)
+	ok = (cond.Op == token.LAND || cond.Op == token.LOR) &&
+		(okX && isErrCompare(condX, p.IsErr, r.nilIdent, true)) &&
+		(okY && isErrCompare(condY, p.IsErr, r.nilIdent, false))
+	if ok && !p.Ignored(n) {
+		cond.Y = r.isExpr(condY)
+		p.Rewrote(n)
+		return true
+	}
+
+	return
+}
+
+func (r *isRule) isExpr(cond *dst.BinaryExpr) dst.Expr {
+	call := &dst.CallExpr{
+		Fun:  r.selector(r.errorsIdent, r.isIdent),
+		Args: []dst.Expr{cond.X, cond.Y},
+	}
+	if cond.Op == token.NEQ {
+		return &dst.UnaryExpr{Op: token.NOT, X: call}
+	}
+	return call
+}
+
+type asRule struct {
+	errorsSelectors
+	errorsIdent string
+	asIdent     string
+	// cause makes the rule rewrite the assertions of errors.Cause(err) instead of err.
+	cause   bool
+	changed bool
+}
+
+func newAsRule() Rule {
+	return &asRule{
+		errorsIdent: "errors",
+		asIdent:     "As",
+	}
+}
+
+func (r *asRule) Name() string {
+	return ruleAs
+}
+
+func (r *asRule) Description() string {
+	return "assert error types with errors.As instead of type assertions and type switches"
+}
+
+func (r *asRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	changed := false
+	switch n := n.(type) {
+	case *dst.BlockStmt:
+		n.List, changed = r.fixStmtList(p, n.List)
+	case *dst.CaseClause:
+		n.Body, changed = r.fixStmtList(p, n.Body)
+	case *dst.CommClause:
+		n.Body, changed = r.fixStmtList(p, n.Body)
+	}
+	r.changed = r.changed || changed
+	return nil
+}
+
+func (r *asRule) EndProcess(ctx context.Context, p *Pass, f *dst.File) (bool, error) {
+	if r.changed {
+		r.rename(useStdErrors(f))
+	}
+	return r.changed, nil
+}
+
+func (r *asRule) fixStmtList(p *Pass, list []dst.Stmt) ([]dst.Stmt, bool) {
+	changed := false
+	stmts := make([]dst.Stmt, 0, len(list))
+	// declared holds the names declared by the statements of the list so far, which must not be declared again.
+	declared := map[string]bool{}
+	for _, stmt := range list {
+		switch s := stmt.(type) {
+		case *dst.IfStmt:
+			// if e, ok := err.(T); ok {
+			// ->
+			// if e := (*T)(nil); errors.As(err, &e) {
+			var ok bool
+			stmt, ok = r.fixIfStmt(p, s)
+			changed = changed || ok
+		case *dst.AssignStmt:
+			// e, ok := err.(T)
+			// ->
+			// var e T
+			// ok := errors.As(err, &e)
+			spec, ok := r.fixAssignStmt(p, s)
+			if spec != nil && declared[spec.Names[0].Name] {
+				spec = nil
+			}
+			if ok && s.Tok == token.DEFINE && declared[s.Lhs[0].(*dst.Ident).Name] {
+				s.Tok = token.ASSIGN
+			}
+			if spec != nil {
+				decl := declStmt(spec)
+				moveStartDecs(stmt, decl)
+				stmts = append(stmts, decl)
+			}
+			changed = changed || ok
+		case *dst.TypeSwitchStmt:
+			// switch e := err.(type) {
+			// ->
+			// if e := (*T)(nil); errors.As(err, &e) {
+			if ifStmt := r.fixTypeSwitchStmt(p, s); ifStmt != nil {
+				stmt = ifStmt
+				changed = true
+			}
+		}
+		for _, name := range declaredNames(stmt) {
+			declared[name] = true
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts, changed
+}
+
+// fixIfStmt rewrites the assertion of the init statement of n, and those of the if statements of its else branches.
+// The target of errors.As stays scoped to the if statement: it is declared by the init statement when ok is only used
+// by the condition, and otherwise in a block around n, which is returned instead of n.
+func (r *asRule) fixIfStmt(p *Pass, n *dst.IfStmt) (dst.Stmt, bool) {
+	var stmt dst.Stmt = n
+	changed := false
+	// The else branches are rewritten first, so that the ok variables they declare no longer hide the use of ok.
+	if elseIf, ok := n.Else.(*dst.IfStmt); ok {
+		n.Else, changed = r.fixIfStmt(p, elseIf)
+	}
+	if assign, ok := n.Init.(*dst.AssignStmt); ok {
+		spec, initChanged := r.fixAssignStmt(p, assign)
+		changed = changed || initChanged
+		if spec != nil {
+			okIdent, _ := assign.Lhs[0].(*dst.Ident)
+			if okIdent != nil && assign.Tok == token.DEFINE && countName(n.Cond, okIdent.Name) == 1 &&
+				!usesName([]dst.Stmt{n.Body}, okIdent.Name) && (n.Else == nil || !usesName([]dst.Stmt{n.Else}, okIdent.Name)) {
+				// if e, ok := err.(T); ok && e.Temporary() {
+				// ->
+				// if e := (*T)(nil); errors.As(err, &e) && e.Temporary() {
+				call := assign.Rhs[0]
+				n.Cond = dstutil.Apply(n.Cond, func(c *dstutil.Cursor) bool {
+					if id, ok := c.Node().(*dst.Ident); ok && id.Name == okIdent.Name && c.Name() != "Sel" {
+						c.Replace(call)
+					}
+					return true
+				}, nil).(dst.Expr)
+				n.Init = &dst.AssignStmt{Lhs: []dst.Expr{spec.Names[0]}, Tok: token.DEFINE, Rhs: []dst.Expr{zeroExpr(spec.Type)}}
+			} else {
+				// if e, ok := err.(T); ok || e == nil {
+				// ->
+				// {
+				// 	var e T
+				// 	if ok := errors.As(err, &e); ok || e == nil {
+				// }
+				block := &dst.BlockStmt{List: []dst.Stmt{declStmt(spec), n}}
+				block.Decs.Before, block.Decs.Start, block.Decs.After, block.Decs.End = n.Decs.Before, n.Decs.Start, n.Decs.After, n.Decs.End
+				n.Decs.Before, n.Decs.Start, n.Decs.After, n.Decs.End = dst.NewLine, nil, dst.NewLine, nil
+				stmt = block
+			}
+		}
+	}
+	return stmt, changed
+}
+
+// fixAssignStmt rewrites "e, ok := err.(T)" into "ok := errors.As(err, &e)".
+// It returns the declaration of e to insert before the statement when the statement declared it.
+func (r *asRule) fixAssignStmt(p *Pass, n *dst.AssignStmt) (decl *dst.ValueSpec, changed bool) {
+	if len(n.Lhs) != 2 || len(n.Rhs) != 1 {
+		return
+	}
+	assert, ok := n.Rhs[0].(*dst.TypeAssertExpr)
+	if !ok || assert.Type == nil {
+		return
+	}
+	x := assert.X
+	if r.cause {
+		x, ok = causeArg(p, x)
+	} else {
+		ok = p.IsErr(x)
+	}
+	if !ok {
+		return
+	}
+	target, ok := n.Lhs[0].(*dst.Ident)
+	if !ok || (isName(target, "_") && isName(n.Lhs[1], "_")) || p.Ignored(n) {
+		return
+	}
+
+	var ptr dst.Expr
+	if isName(target, "_") {
+		ptr = &dst.CallExpr{Fun: dst.NewIdent("new"), Args: []dst.Expr{assert.Type}}
+	} else {
+		ptr = &dst.UnaryExpr{Op: token.AND, X: dst.NewIdent(target.Name)}
+		if n.Tok == token.DEFINE {
+			decl = &dst.ValueSpec{Names: []*dst.Ident{target}, Type: assert.Type}
+		}
+	}
+
+	n.Lhs = n.Lhs[1:]
+	n.Rhs = []dst.Expr{r.asExpr(x, ptr)}
+	if isName(n.Lhs[0], "_") {
+		n.Tok = token.ASSIGN
+	}
+	p.Rewrote(n)
+	return decl, true
+}
+
+func (r *asRule) asExpr(x, target dst.Expr) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun:  r.selector(r.errorsIdent, r.asIdent),
+		Args: []dst.Expr{x, target},
+	}
+}
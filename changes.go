@@ -0,0 +1,203 @@
+package errfix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// LineRange is a range of lines of a file, from Start to End included, counted from 1.
+type LineRange struct {
+	Start, End int
+}
+
+// Changes are the changed lines of the go files of a git repository, as returned by GitChanges.
+type Changes struct {
+	// Files maps the absolute paths of the changed files to their changed lines.
+	Files map[string][]LineRange
+}
+
+// GitChanges returns the go files of the git repository of the working directory that differ from the revision rev,
+// such as main or HEAD~1, with the lines that were added or modified. Untracked files that are not ignored
+// count as changed entirely, while removed lines do not count.
+func GitChanges(ctx context.Context, rev string) (*Changes, error) {
+	out, err := git(ctx, "", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root := strings.TrimSpace(out)
+
+	out, err = git(ctx, root, "diff", "--no-color", "--no-ext-diff", "--unified=0", rev, "--", "*.go")
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseGitDiff(root, out)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err = git(ctx, root, "ls-files", "--others", "--exclude-standard", "--", "*.go")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(out, "\n") {
+		if name != "" {
+			c.Files[filepath.Join(root, filepath.FromSlash(name))] = []LineRange{{Start: 1, End: math.MaxInt32}}
+		}
+	}
+	return c, nil
+}
+
+// git runs a git command in dir and returns its output.
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("error running git %s, %s", args[0], msg)
+	}
+	return string(out), nil
+}
+
+// parseGitDiff returns the added lines of a diff with no context, whose paths are relative to root.
+func parseGitDiff(root, diff string) (*Changes, error) {
+	c := &Changes{Files: map[string][]LineRange{}}
+	name := ""
+	s := bufio.NewScanner(strings.NewReader(diff))
+	s.Buffer(nil, len(diff)+1)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			name = ""
+			p := strings.TrimPrefix(line, "+++ ")
+			if strings.HasPrefix(p, `"`) {
+				if uq, err := strconv.Unquote(p); err == nil {
+					p = uq
+				}
+			}
+			// Removed files have no new lines.
+			if strings.HasPrefix(p, "b/") {
+				name = filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(p, "b/")))
+			}
+		case strings.HasPrefix(line, "@@ ") && name != "":
+			// @@ -start,count +start,count @@, where a count of 1 may be left out.
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("invalid hunk header %q", line)
+			}
+			start, count := fields[2][1:], "1"
+			if i := strings.Index(start, ","); i >= 0 {
+				start, count = start[:i], start[i+1:]
+			}
+			l, err1 := strconv.Atoi(start)
+			n, err2 := strconv.Atoi(count)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid hunk header %q", line)
+			}
+			if n > 0 {
+				c.Files[name] = append(c.Files[name], LineRange{Start: l, End: l + n - 1})
+			}
+		}
+	}
+	return c, nil
+}
+
+// Names returns the absolute paths of the changed files in alphabetical order.
+func (c *Changes) Names() []string {
+	names := make([]string, 0, len(c.Files))
+	for name, lines := range c.Files {
+		if len(lines) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lines returns the changed lines of the file name, which is nil when the file did not change.
+func (c *Changes) Lines(name string) []LineRange {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil
+	}
+	if lines, ok := c.Files[abs]; ok {
+		return lines
+	}
+	// git reports the paths with symbolic links resolved.
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return c.Files[resolved]
+	}
+	return nil
+}
+
+// Changed returns true when some lines of the file name changed.
+func (c *Changes) Changed(name string) bool {
+	return len(c.Lines(name)) > 0
+}
+
+// WithChangedFiles restricts the files read to those that changed.
+func WithChangedFiles(c *Changes) ReaderOption {
+	return func(r *reader) {
+		r.changes = c
+	}
+}
+
+// WithChangedLines restricts the rewrites and the notes to the code that overlaps the changed lines,
+// so that only new code is flagged. Files that did not change are left as they are.
+func WithChangedLines(c *Changes) ProcessorOption {
+	return func(p *processor) {
+		p.changes = c
+	}
+}
+
+// outsideChanges returns true when the changed lines of the file are restricted and n does not overlap them.
+// Nodes created by the rules are never outside. Statements with a body, such as if statements,
+// are outside unless the lines of their header changed.
+func (ps *Pass) outsideChanges(n dst.Node) bool {
+	if !ps.changesOnly {
+		return false
+	}
+	an, ok := ps.dec.Ast.Nodes[headerNode(n)]
+	if !ok {
+		return false
+	}
+	start := ps.dec.Fset.Position(an.Pos()).Line
+	end := ps.dec.Fset.Position(an.End()).Line
+	for _, r := range ps.changed {
+		if start <= r.End && end >= r.Start {
+			return false
+		}
+	}
+	return true
+}
+
+// headerNode returns the part of n that rules rewrite: the condition or tag of statements with a body, or n itself.
+func headerNode(n dst.Node) dst.Node {
+	switch s := n.(type) {
+	case *dst.IfStmt:
+		return s.Cond
+	case *dst.SwitchStmt:
+		if s.Tag != nil {
+			return s.Tag
+		}
+	case *dst.TypeSwitchStmt:
+		return s.Assign
+	}
+	return n
+}
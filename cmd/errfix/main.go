@@ -3,52 +3,367 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/yaoguais/errfix"
 )
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: errfix [-w] [-q] [-e] [path ...]\n")
+	fmt.Fprintf(os.Stderr, "usage: errfix [-l | -stat] [-w] [-q] [-e] [-keep-going] [-timeout duration] [-mode pkg|std] [-types] [-errname pattern] [-rules name,...] [-std-sentinels] [-rule-files file,...] [-message-style keep|lower] [-format diff|json|sarif|patch] [-patch-dir dir [-patch-per-package]] [-stream] [-config file] [-tags tag,...] [-include pattern,...] [-exclude pattern,...] [-generated] [-gitignore] [-diff-base rev [-diff-lines]] [-baseline file | -baseline-write file] [path | package ...]\n")
 	flag.PrintDefaults()
-	os.Exit(2)
+	os.Exit(exitSetupError)
 }
 
 func main() {
 	quiet := flag.Bool("q", false, "quiet (no output)")
+	list := flag.Bool("l", false, "list the files that would change instead of printing the diff")
+	stat := flag.Bool("stat", false, "print a table of the changed files with the number of rewrites per rule instead of the diff")
 	write := flag.Bool("w", false, "write result to (source) file instead of stdout")
+	timeout := flag.Duration("timeout", 0, "maximum time to process a file, such as 30s (default no limit)")
+	keepGoing := flag.Bool("keep-going", false, "process all files when some fail, and report the failures at the end")
 	setExitStatus := flag.Bool("e", false, "set exit status to 1 if any changes are found")
+	modeName := flag.String("mode", "pkg", "rewrite toward github.com/pkg/errors (pkg) or the standard library (std)")
+	typeCheck := flag.Bool("types", false, "detect errors by their type instead of the name err")
+	errName := flag.String("errname", "", "regular expression that names of error variables must match (default ^err$)")
+	stdSentinels := flag.Bool("std-sentinels", false, "rewrite package-level fmt.Errorf sentinels without arguments to errors.New of the standard library")
+	ruleFiles := flag.String("rule-files", "", "comma-separated files of pattern rules to run after the rules of the mode")
+	rules := flag.String("rules", "", "comma-separated names of the rules to run instead of the rules of the mode")
+	messageStyle := flag.String("message-style", "", "style of the messages of rewritten errors, keep or lower (default keep)")
+	stream := flag.Bool("stream", false, "print diffs as soon as files are processed, in input order, instead of sorted by file name")
+	format := flag.String("format", "diff", "output format, diff, json, sarif or patch")
+	patchDir := flag.String("patch-dir", "", "write the patch into "+errfix.PatchFileName+" of a directory instead of stdout (implies -format patch)")
+	patchPerPackage := flag.Bool("patch-per-package", false, "with -patch-dir, write a patch per directory instead of a single one")
+	tags := flag.String("tags", "", "comma-separated build tags to resolve package patterns such as ./... with")
+	include := flag.String("include", "", "comma-separated patterns of the files to read from directories and packages, such as 'internal/**'")
+	exclude := flag.String("exclude", "", "comma-separated patterns of the files and directories to skip in directories and packages, such as 'internal/legacy/**'")
+	generated := flag.Bool("generated", false, "process generated files, marked with a // Code generated ... DO NOT EDIT. comment")
+	gitignore := flag.Bool("gitignore", false, "skip the files and directories ignored by .gitignore files")
+	diffBase := flag.String("diff-base", "", "only process the go files that differ from a git revision, such as main")
+	diffLines := flag.Bool("diff-lines", false, "with -diff-base, only rewrite the lines that differ from the revision")
+	baselineFile := flag.String("baseline", "", "leave unchanged and do not report the rewrites recorded in a baseline file")
+	baselineWrite := flag.String("baseline-write", "", "record the rewrites in a baseline file, to accept them with -baseline")
+	configFile := flag.String("config", "", "read settings from a YAML file instead of the "+errfix.ConfigFileName+" files of the input directories")
 	flag.Usage = usage
 	flag.Parse()
 
+	if *diffLines && *diffBase == "" {
+		fmt.Fprintf(os.Stderr, "-diff-lines requires -diff-base\n")
+		usage()
+	}
+	var changes *errfix.Changes
+	if *diffBase != "" {
+		var err error
+		changes, err = errfix.GitChanges(context.Background(), *diffBase)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitSetupError)
+		}
+	}
+
+	if *baselineFile != "" && *baselineWrite != "" {
+		fmt.Fprintf(os.Stderr, "-baseline and -baseline-write cannot be used together\n")
+		usage()
+	}
+	var baseline, record *errfix.Baseline
+	if *baselineFile != "" {
+		var err error
+		baseline, err = errfix.LoadBaseline(*baselineFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitSetupError)
+		}
+	}
+	if *baselineWrite != "" {
+		record = errfix.NewBaseline()
+	}
+
+	// Command-line flags take precedence over configuration files.
+	override := func(cfg *errfix.Config) {
+		if *diffLines {
+			cfg.Options = append(cfg.Options, errfix.WithChangedLines(changes))
+		}
+		if baseline != nil {
+			cfg.Options = append(cfg.Options, errfix.WithBaseline(baseline))
+		}
+		if record != nil {
+			cfg.Options = append(cfg.Options, errfix.WithBaselineRecord(record))
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "mode":
+				cfg.Mode = *modeName
+			case "rules":
+				cfg.Rules = errfix.SplitList(*rules)
+			case "types":
+				cfg.Types = *typeCheck
+			case "errname":
+				cfg.ErrName = *errName
+			case "std-sentinels":
+				cfg.StdSentinels = *stdSentinels
+			case "rule-files":
+				cfg.RuleFiles = nil
+				for _, name := range errfix.SplitList(*ruleFiles) {
+					// Rule files of the command line are relative to the working directory, not to the config file.
+					if abs, err := filepath.Abs(name); err == nil {
+						name = abs
+					}
+					cfg.RuleFiles = append(cfg.RuleFiles, name)
+				}
+			case "message-style":
+				cfg.MessageStyle = *messageStyle
+			}
+		})
+	}
+	if *patchDir != "" {
+		*format = "patch"
+	}
+	if *format != "diff" && *format != "json" && *format != "sarif" && *format != "patch" {
+		fmt.Fprintf(os.Stderr, "unknown format %q, expected diff, json, sarif or patch\n", *format)
+		usage()
+	}
+	if *list && *stat {
+		fmt.Fprintf(os.Stderr, "-l and -stat cannot be used together\n")
+		usage()
+	}
+	flagCfg := &errfix.Config{}
+	override(flagCfg)
+	if _, err := flagCfg.ProcessorOptions(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		usage()
+	}
+
+	var p errfix.Processor
+	if *configFile != "" {
+		cfg, err := errfix.LoadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitSetupError)
+		}
+		override(cfg)
+		p, err = cfg.Processor()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			usage()
+		}
+	} else {
+		p = errfix.NewConfigProcessor(override)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 && changes != nil {
+		// Without paths, the changed files of the repository are read.
+		args = []string{"."}
+		if names := changes.Names(); len(names) > 0 {
+			args = relNames(names)
+		}
+	}
 	var r errfix.Reader
-	if flag.NArg() == 0 {
+	if len(args) == 0 {
 		r = errfix.NewReader(os.Stdin)
 	} else {
-		args := flag.Args()
 		inputs := []interface{}{}
-		for i := 0; i < len(args); i++ {
-			inputs = append(inputs, args[i])
+		// Package patterns are loaded together, which is much faster than loading them one by one.
+		pkgs := errfix.Packages{}
+		if *tags != "" {
+			pkgs.BuildFlags = []string{"-tags=" + *tags}
+		}
+		at := -1
+		for _, arg := range args {
+			if !errfix.IsPattern(arg) {
+				inputs = append(inputs, arg)
+				continue
+			}
+			if at < 0 {
+				at = len(inputs)
+				inputs = append(inputs, nil)
+			}
+			pkgs.Patterns = append(pkgs.Patterns, arg)
+		}
+		if at >= 0 {
+			inputs[at] = pkgs
+		}
+		inputs = append(inputs,
+			errfix.WithInclude(errfix.SplitList(*include)...),
+			errfix.WithExclude(errfix.SplitList(*exclude)...),
+			errfix.WithGenerated(*generated),
+			errfix.WithGitignore(*gitignore),
+		)
+		if changes != nil {
+			inputs = append(inputs, errfix.WithChangedFiles(changes))
 		}
 		r = errfix.NewReader(inputs...)
 	}
 
-	w := errfix.NewDiffWriter(*write)
-	p := errfix.NewProcessor()
-	ef := errfix.NewErrFix(r, p, w)
-	err := ef.Process(context.Background())
+	dw := errfix.NewDiffWriter(*write)
+	if *stream {
+		out := io.Writer(os.Stdout)
+		if *quiet {
+			out = io.Discard
+		}
+		dw = errfix.NewStreamDiffWriter(out, *write)
+	}
+	jw := errfix.NewJSONWriter(*write)
+	sw := errfix.NewSARIFWriter(*write)
+	stw := errfix.NewStatWriter(*write)
+	pw := errfix.NewPatchWriter(*write)
+	var w errfix.Writer = dw
+	switch {
+	case *list || *stat:
+		w = stw
+	case *format == "json":
+		w = jw
+	case *format == "sarif":
+		w = sw
+	case *format == "patch":
+		w = pw
+	}
+	// Ctrl-C stops reading and processing files.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ef := errfix.NewErrFix(r, p, w, errfix.WithKeepGoing(*keepGoing), errfix.WithFileTimeout(*timeout))
+	processErr := ef.Process(ctx)
+	if errors.Is(processErr, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "interrupted\n")
+		os.Exit(exitInterrupted)
+	}
+	if processErr != nil && !*keepGoing {
+		fmt.Fprintf(os.Stderr, "%s\n", processErr)
+		os.Exit(exitCode(processErr))
+	}
+	var err error
+	if record != nil {
+		err = record.Save(*baselineWrite)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitWriteError)
+		}
+	}
+
+	changed := false
+	var notes []errfix.Note
+	switch {
+	case *list || *stat:
+		changed = len(stw.Stats()) > 0
+		notes = stw.Notes()
+		if !*quiet && *list {
+			err = stw.List(os.Stdout)
+		} else if !*quiet {
+			err = stw.Table(os.Stdout)
+		}
+	case *format == "json":
+		changed = jw.Changed()
+		notes = jw.Notes()
+		if !*quiet {
+			err = jw.Encode(os.Stdout)
+		}
+	case *format == "sarif":
+		changed = len(sw.Log().Runs[0].Results) > 0
+		notes = sw.Notes()
+		if !*quiet {
+			err = sw.Encode(os.Stdout)
+		}
+	case *format == "patch":
+		patch := pw.Patch()
+		changed = patch != ""
+		notes = pw.Notes()
+		if *patchDir != "" {
+			var names []string
+			names, err = pw.WriteDir(*patchDir, *patchPerPackage)
+			for _, name := range names {
+				if !*quiet {
+					fmt.Fprintln(os.Stdout, name)
+				}
+			}
+		} else if !*quiet {
+			fmt.Fprint(os.Stdout, patch)
+		}
+	default:
+		changed = dw.Changed()
+		notes = dw.Notes()
+		if !*quiet && !*stream {
+			fmt.Fprint(os.Stdout, dw.DiffString())
+		}
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(1)
+		os.Exit(exitWriteError)
 	}
-
-	diff := w.DiffString()
 	if !*quiet {
-		fmt.Fprint(os.Stdout, diff)
+		for _, n := range notes {
+			fmt.Fprintf(os.Stderr, "%s\n", n)
+		}
+	}
+	// In keep-going mode, the output of the other files comes before the failures.
+	if processErr != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", processErr)
+		os.Exit(exitCode(processErr))
 	}
-	if diff != "" && *setExitStatus {
-		os.Exit(1)
+	if changed && *setExitStatus {
+		os.Exit(exitChanged)
+	}
+}
+
+// Exit codes of errfix. exitChanged is only used by -e, so that failures are never mistaken for changes.
+// When files fail in different ways, the highest code is used.
+const (
+	exitChanged = 1
+	// exitSetupError is used for invalid flags and configurations, and for the failures that come before the files
+	// are processed, such as packages that cannot be loaded.
+	exitSetupError   = 2
+	exitReadError    = 3
+	exitProcessError = 4
+	// exitWriteError is used as well when the output, a patch or a baseline cannot be written.
+	exitWriteError = 5
+	// exitInterrupted is the conventional exit code of a process stopped by SIGINT.
+	exitInterrupted = 130
+)
+
+// exitCode returns the exit code of an error of ErrFix.Process.
+func exitCode(err error) int {
+	var errs errfix.FileErrors
+	if !errors.As(err, &errs) {
+		var fe *errfix.FileError
+		if !errors.As(err, &fe) {
+			return exitSetupError
+		}
+		errs = errfix.FileErrors{fe}
+	}
+	code := exitSetupError
+	for _, fe := range errs {
+		c := exitProcessError
+		switch fe.Op {
+		case errfix.OpRead:
+			c = exitReadError
+		case errfix.OpWrite:
+			c = exitWriteError
+		}
+		if c > code {
+			code = c
+		}
+	}
+	return code
+}
+
+// relNames returns the names relative to the working directory when they are below it.
+func relNames(names []string) []string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return names
+	}
+	rels := make([]string, len(names))
+	for i, name := range names {
+		rels[i] = name
+		if rel, err := filepath.Rel(wd, name); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			rels[i] = rel
+		}
 	}
+	return rels
 }
@@ -0,0 +1,13 @@
+// Package main creates an errfixlint tool, that reports the rewrites of errfix as diagnostics.
+// It runs on its own with package patterns, or as go vet -vettool=$(which errfixlint).
+package main
+
+import (
+	"golang.org/x/tools/go/analysis/singlechecker"
+
+	"github.com/yaoguais/errfix"
+)
+
+func main() {
+	singlechecker.Main(errfix.Analyzer)
+}
@@ -0,0 +1,377 @@
+package errfix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileName is the name of the configuration files looked up by LoadDirConfig.
+const ConfigFileName = ".errfix.yaml"
+
+// Config is the content of an errfix configuration file.
+// Empty fields keep the defaults of NewProcessor.
+type Config struct {
+	// Root stops the lookup of configuration files in parent directories.
+	Root bool `yaml:"root"`
+	// Mode is the error package to rewrite toward, "pkg" or "std".
+	Mode string `yaml:"mode"`
+	// Rules are the names of the registered rules to run instead of the built-in rules of the mode,
+	// or of rule sets such as modernize.
+	Rules []string `yaml:"rules"`
+	// Types enables type-aware detection of errors.
+	Types bool `yaml:"types"`
+	// ErrName is the regular expression that the names of error variables must match, such as ^(err|.*Err)$.
+	ErrName string `yaml:"err-name"`
+	// Sentinels are errors, in addition to DefaultSentinels, that must be returned unwrapped by contract.
+	Sentinels []string `yaml:"sentinels"`
+	// StdSentinels rewrites package-level fmt.Errorf sentinels without arguments into errors.New of the standard library.
+	StdSentinels bool `yaml:"std-sentinels"`
+	// RuleFiles are files of pattern rules, relative to the directory of the configuration file.
+	RuleFiles []string `yaml:"rule-files"`
+	// Exclude are patterns of paths, relative to the directory of the configuration file, of files to leave unchanged.
+	// The patterns of a Config that is not loaded from files are relative to the working directory.
+	// Patterns without a slash match any element of the path, such as vendor or *_gen.go.
+	Exclude []string `yaml:"exclude"`
+	// MessageStyle is the style of the messages of rewritten errors, "keep" or "lower".
+	MessageStyle string `yaml:"message-style"`
+	// Options are added after the options of the other fields, for settings that files cannot hold,
+	// such as WithChangedLines.
+	Options []ProcessorOption `yaml:"-"`
+
+	// excludes are the patterns of Exclude of every loaded file, with the directory they are relative to.
+	excludes []excludePattern
+}
+
+type excludePattern struct {
+	dir     string
+	pattern string
+}
+
+// LoadConfig reads a YAML configuration file.
+func LoadConfig(name string) (*Config, error) {
+	c := &Config{}
+	err := c.load(name)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadDirConfig returns the configuration of the files of dir, merged from the ConfigFileName files
+// found in dir and its parents. The files of nested directories override the fields they set,
+// and the lookup stops at a file that sets root. Exclude patterns add up instead.
+// Without any file, the configuration is empty.
+func LoadDirConfig(dir string) (*Config, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving directory %s, %v", dir, err)
+	}
+
+	var names []string
+	for {
+		name := filepath.Join(dir, ConfigFileName)
+		if _, err := os.Stat(name); err == nil {
+			names = append(names, name)
+			layer, err := LoadConfig(name)
+			if err != nil {
+				return nil, err
+			}
+			if layer.Root {
+				break
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	c := &Config{}
+	for i := len(names) - 1; i >= 0; i-- {
+		err := c.load(names[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// decodeConfig decodes data over c. Unknown keys are errors that name them, so that misspelled options are not
+// silently ignored.
+func decodeConfig(data []byte, c *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(c)
+	if err == io.EOF {
+		// The file is empty.
+		return nil
+	}
+	return err
+}
+
+// load reads the configuration file name over c, so that the fields set by the file override those of c.
+// Relative paths are resolved against the directory of the file.
+func (c *Config) load(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("error reading config, %v", err)
+	}
+	// The file is decoded on its own first, to know which paths it sets.
+	layer := &Config{}
+	err = decodeConfig(data, layer)
+	if err == nil {
+		err = decodeConfig(data, c)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing config %s, %v", name, err)
+	}
+
+	dir := filepath.Dir(name)
+	if layer.RuleFiles != nil {
+		c.RuleFiles = nil
+		for _, p := range layer.RuleFiles {
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(dir, p)
+			}
+			c.RuleFiles = append(c.RuleFiles, p)
+		}
+	}
+	for _, p := range layer.Exclude {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q in config %s, %v", p, name, err)
+		}
+		c.excludes = append(c.excludes, excludePattern{dir: dir, pattern: p})
+	}
+	return nil
+}
+
+// Excluded returns true when the file name matches one of the exclude patterns.
+func (c *Config) Excluded(name string) bool {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	for _, e := range c.excludePatterns() {
+		rel, err := filepath.Rel(e.dir, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if matchExclude(e.pattern, filepath.ToSlash(rel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludePatterns returns the exclude patterns of the loaded files,
+// or those of Exclude relative to the working directory when no file was loaded.
+func (c *Config) excludePatterns() []excludePattern {
+	if len(c.excludes) > 0 || len(c.Exclude) == 0 {
+		return c.excludes
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	excludes := make([]excludePattern, 0, len(c.Exclude))
+	for _, p := range c.Exclude {
+		excludes = append(excludes, excludePattern{dir: dir, pattern: p})
+	}
+	return excludes
+}
+
+// matchExclude matches a slash-separated relative path, or one of its parent directories, against pattern.
+func matchExclude(pattern, rel string) bool {
+	parts := strings.Split(rel, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, part := range parts {
+			if ok, _ := path.Match(pattern, part); ok {
+				return true
+			}
+		}
+		return false
+	}
+	pattern = strings.Trim(pattern, "/")
+	for i := range parts {
+		if ok, _ := path.Match(pattern, strings.Join(parts[:i+1], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ProcessorOptions converts the configuration to options of NewProcessor.
+// It returns an error when a field has an invalid value.
+func (c *Config) ProcessorOptions() ([]ProcessorOption, error) {
+	var opts []ProcessorOption
+	for _, e := range c.excludePatterns() {
+		if _, err := path.Match(e.pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q, %v", e.pattern, err)
+		}
+	}
+	if c.Mode != "" {
+		mode, err := ParseMode(c.Mode)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithMode(mode))
+	}
+	if len(c.Rules) > 0 {
+		var rules []NewRuleFunc
+		for _, name := range c.Rules {
+			names := []string{name}
+			if set, ok := ruleSets[name]; ok {
+				names = set
+			}
+			for _, name := range names {
+				newRule, err := LookupRule(name)
+				if err != nil {
+					return nil, err
+				}
+				rules = append(rules, newRule)
+			}
+		}
+		opts = append(opts, WithRuleSet(rules...))
+	}
+	if c.Types {
+		opts = append(opts, WithTypeCheck(true))
+	}
+	if c.ErrName != "" {
+		re, err := regexp.Compile(c.ErrName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid err-name pattern, %v", err)
+		}
+		opts = append(opts, WithErrName(re))
+	}
+	if len(c.Sentinels) > 0 {
+		opts = append(opts, WithSentinels(c.Sentinels...))
+	}
+	if c.StdSentinels {
+		opts = append(opts, WithStdSentinels(true))
+	}
+	for _, name := range c.RuleFiles {
+		rules, err := LoadPatternRules(name)
+		if err != nil {
+			return nil, err
+		}
+		newRules, err := CompilePatternRules(rules)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithRules(newRules...))
+	}
+	if c.MessageStyle != "" {
+		style, err := ParseMessageStyle(c.MessageStyle)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithMessageStyle(style))
+	}
+	opts = append(opts, c.Options...)
+	return opts, nil
+}
+
+// Processor returns a Processor with the options of the configuration, that leaves excluded files unchanged.
+func (c *Config) Processor() (Processor, error) {
+	p, err := c.processor()
+	if err != nil {
+		return nil, err
+	}
+	return &excludeProcessor{c: c, p: p}, nil
+}
+
+func (c *Config) processor() (*processor, error) {
+	opts, err := c.ProcessorOptions()
+	if err != nil {
+		return nil, err
+	}
+	return newProcessor(opts...), nil
+}
+
+type excludeProcessor struct {
+	c *Config
+	p Processor
+}
+
+func (p *excludeProcessor) Process(ctx context.Context, f *File) (*File, error) {
+	if p.c.Excluded(f.Name) {
+		return &File{Name: f.Name, Content: f.Content}, nil
+	}
+	return p.p.Process(ctx, f)
+}
+
+// NewConfigProcessor returns a Processor that processes every file with the configuration of its directory,
+// as returned by LoadDirConfig. Files that are not on disk, such as stdin, use the configuration of the working directory.
+// When override is not nil, it is applied to every configuration, to give precedence to command-line flags for example.
+func NewConfigProcessor(override func(*Config)) Processor {
+	return newConfigProcessor(override)
+}
+
+func newConfigProcessor(override func(*Config)) *configProcessor {
+	return &configProcessor{override: override, dirs: map[string]*dirProcessor{}}
+}
+
+type configProcessor struct {
+	override func(*Config)
+	mu       sync.Mutex
+	dirs     map[string]*dirProcessor
+}
+
+type dirProcessor struct {
+	once sync.Once
+	c    *Config
+	p    *processor
+	err  error
+}
+
+func (p *configProcessor) Process(ctx context.Context, f *File) (*File, error) {
+	dir := "."
+	if fi, err := os.Stat(f.Name); err == nil && fi.Mode().IsRegular() {
+		dir = filepath.Dir(f.Name)
+	}
+	c, dp, err := p.lookup(dir)
+	if err != nil {
+		return nil, err
+	}
+	if c.Excluded(f.Name) {
+		return &File{Name: f.Name, Content: f.Content}, nil
+	}
+	return dp.Process(ctx, f)
+}
+
+// lookup returns the configuration of the directory dir and the processor it configures.
+func (p *configProcessor) lookup(dir string) (*Config, *processor, error) {
+	p.mu.Lock()
+	d, ok := p.dirs[dir]
+	if !ok {
+		d = &dirProcessor{}
+		p.dirs[dir] = d
+	}
+	p.mu.Unlock()
+
+	d.once.Do(func() {
+		d.c, d.err = LoadDirConfig(dir)
+		if d.err != nil {
+			return
+		}
+		if p.override != nil {
+			p.override(d.c)
+		}
+		d.p, d.err = d.c.processor()
+		if d.err != nil {
+			d.err = fmt.Errorf("invalid config of %s, %v", dir, d.err)
+		}
+	})
+	return d.c, d.p, d.err
+}
@@ -0,0 +1,178 @@
+package errfix
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// DefaultSentinels are the sentinel errors that must stay unwrapped by contract,
+// because callers of the standard library compare them with ==.
+var DefaultSentinels = []string{
+	"io.EOF",
+	"io.ErrUnexpectedEOF",
+	"sql.ErrNoRows",
+	"context.Canceled",
+	"context.DeadlineExceeded",
+	"bufio.ErrFinalToken",
+	"filepath.SkipDir",
+	"filepath.SkipAll",
+	"fs.SkipDir",
+	"fs.SkipAll",
+	"driver.ErrSkip",
+	"driver.ErrBadConn",
+	"driver.ErrRemoveArgument",
+}
+
+// contractMethods maps the signatures of methods of well-known interfaces to the interface.
+// The errors returned by these methods are compared with sentinels by their callers, so they must not be wrapped.
+var contractMethods = map[string]string{
+	"Read([]byte) (int, error)":           "io.Reader",
+	"ReadAt([]byte, int64) (int, error)":  "io.ReaderAt",
+	"ReadByte() (byte, error)":            "io.ByteReader",
+	"ReadRune() (rune, int, error)":       "io.RuneReader",
+	"Write([]byte) (int, error)":          "io.Writer",
+	"WriteAt([]byte, int64) (int, error)": "io.WriterAt",
+	"Seek(int64, int) (int64, error)":     "io.Seeker",
+	"Close() error":                       "io.Closer",
+
+	"Next([]driver.Value) error":                                                       "driver.Rows",
+	"Prepare(string) (driver.Stmt, error)":                                             "driver.Conn",
+	"Begin() (driver.Tx, error)":                                                       "driver.Conn",
+	"Exec([]driver.Value) (driver.Result, error)":                                      "driver.Stmt",
+	"Query([]driver.Value) (driver.Rows, error)":                                       "driver.Stmt",
+	"Exec(string, []driver.Value) (driver.Result, error)":                              "driver.Execer",
+	"Query(string, []driver.Value) (driver.Rows, error)":                               "driver.Queryer",
+	"PrepareContext(context.Context, string) (driver.Stmt, error)":                     "driver.ConnPrepareContext",
+	"BeginTx(context.Context, driver.TxOptions) (driver.Tx, error)":                    "driver.ConnBeginTx",
+	"ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error)": "driver.ExecerContext",
+	"QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error)":  "driver.QueryerContext",
+	"ExecContext(context.Context, []driver.NamedValue) (driver.Result, error)":         "driver.StmtExecContext",
+	"QueryContext(context.Context, []driver.NamedValue) (driver.Rows, error)":          "driver.StmtQueryContext",
+	"Ping(context.Context) error":                                                      "driver.Pinger",
+	"ResetSession(context.Context) error":                                              "driver.SessionResetter",
+	"CheckNamedValue(*driver.NamedValue) error":                                        "driver.NamedValueChecker",
+}
+
+// contractFuncs maps the signatures of well-known function types to the type.
+// They apply to functions and methods of any name.
+var contractFuncs = map[string]string{
+	"([]byte, bool) (int, []byte, error)": "bufio.SplitFunc",
+	"(string, os.FileInfo, error) error":  "filepath.WalkFunc",
+	"(string, fs.FileInfo, error) error":  "filepath.WalkFunc",
+	"(string, fs.DirEntry, error) error":  "fs.WalkDirFunc",
+}
+
+// findContractReturns records the returns of a function that implements a well-known interface or function type.
+// The name is empty for function literals.
+func (r *withStackRule) findContractReturns(p *Pass, name string, isMethod bool, t *dst.FuncType, body *dst.BlockStmt) {
+	if body == nil {
+		return
+	}
+	sig := funcSignature(t)
+	contract, ok := contractFuncs[sig]
+	if !ok && isMethod {
+		contract, ok = contractMethods[name+sig]
+	}
+	if !ok {
+		return
+	}
+
+	what := name
+	if what == "" {
+		what = "the function"
+	}
+	reason := fmt.Sprintf("%s implements %s, whose callers compare the returned error with ==", what, contract)
+	r.markReturns(body, p.IsErr, reason)
+}
+
+// findSentinelIfReturns records the returns of an error in the body of an if statement
+// that has just compared the error with a sentinel, as in "if err == io.EOF { return err }".
+func (r *withStackRule) findSentinelIfReturns(p *Pass, n *dst.IfStmt) {
+	errName, sentinels := r.sentinelCond(p, n.Cond)
+	if errName == "" {
+		return
+	}
+	reason := fmt.Sprintf("%s is %s, which callers compare with ==", errName, strings.Join(sentinels, " or "))
+	r.markReturns(n.Body, func(n dst.Expr) bool { return isName(n, errName) }, reason)
+}
+
+// findSentinelSwitchReturns records the returns of an error in the case clauses of a switch statement
+// that only list sentinels, as in "switch err { case io.EOF: return err }".
+func (r *withStackRule) findSentinelSwitchReturns(p *Pass, n *dst.SwitchStmt) {
+	tag, ok := n.Tag.(*dst.Ident)
+	if !ok || !p.IsErr(tag) {
+		return
+	}
+	for _, stmt := range n.Body.List {
+		clause, ok := stmt.(*dst.CaseClause)
+		if !ok || len(clause.List) == 0 {
+			continue
+		}
+		var sentinels []string
+		for _, e := range clause.List {
+			s := exprString(e)
+			if !p.IsSentinel(e) {
+				sentinels = nil
+				break
+			}
+			sentinels = append(sentinels, s)
+		}
+		if len(sentinels) == 0 {
+			continue
+		}
+		reason := fmt.Sprintf("%s is %s, which callers compare with ==", tag.Name, strings.Join(sentinels, " or "))
+		for _, stmt := range clause.Body {
+			r.markReturns(stmt, func(n dst.Expr) bool { return isName(n, tag.Name) }, reason)
+		}
+	}
+}
+
+// sentinelCond returns the name of the error and the sentinels when cond is
+// "err == S", "errors.Is(err, S)" or a disjunction of them on the same error.
+func (r *withStackRule) sentinelCond(p *Pass, cond dst.Expr) (string, []string) {
+	switch cond := cond.(type) {
+	case *dst.ParenExpr:
+		return r.sentinelCond(p, cond.X)
+	case *dst.BinaryExpr:
+		switch cond.Op {
+		case token.EQL:
+			if p.IsErr(cond.X) && p.IsSentinel(cond.Y) {
+				return cond.X.(*dst.Ident).Name, []string{exprString(cond.Y)}
+			}
+		case token.LOR:
+			nameX, sentinelsX := r.sentinelCond(p, cond.X)
+			nameY, sentinelsY := r.sentinelCond(p, cond.Y)
+			if nameX != "" && nameX == nameY {
+				return nameX, append(sentinelsX, sentinelsY...)
+			}
+		}
+	case *dst.CallExpr:
+		ok := isPkgSelector(cond.Fun, r.errorsIdent, "Is") && len(cond.Args) == 2 &&
+			p.IsErr(cond.Args[0]) && p.IsSentinel(cond.Args[1])
+		if ok {
+			return cond.Args[0].(*dst.Ident).Name, []string{exprString(cond.Args[1])}
+		}
+	}
+	return "", nil
+}
+
+// markReturns records the reason for every return statement in n whose last result is accepted by isErr.
+// Function literals are skipped, as their returns belong to another function.
+func (r *withStackRule) markReturns(n dst.Node, isErr errMatcher, reason string) {
+	dst.Inspect(n, func(n dst.Node) bool {
+		switch n := n.(type) {
+		case *dst.FuncLit:
+			return false
+		case *dst.ReturnStmt:
+			if len(n.Results) > 0 && isErr(n.Results[len(n.Results)-1]) {
+				if _, ok := r.contracts[n]; !ok {
+					r.contracts[n] = reason
+				}
+			}
+		}
+		return true
+	})
+}
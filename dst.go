@@ -5,6 +5,7 @@ import (
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/dave/dst"
 )
@@ -15,14 +16,82 @@ func isName(n dst.Expr, name string) bool {
 	return ok && id.String() == name
 }
 
-// isMatchName returns true when the name of the identifier n matches the regular expression.
-func isMatchName(n dst.Expr, pattern string) bool {
-	re := regexp.MustCompile(pattern)
-	name := ""
-	if id, ok := n.(*dst.Ident); ok {
-		name = id.String()
+// isMatchName returns true when n is an identifier whose name matches the regular expression.
+func isMatchName(n dst.Expr, re *regexp.Regexp) bool {
+	id, ok := n.(*dst.Ident)
+	return ok && re.MatchString(id.Name)
+}
+
+// isErrCompare returns true when cond compares an error accepted by isErr with == or !=.
+// When yIsNil is true the other operand must be nilName, otherwise it must be anything but nilName.
+func isErrCompare(cond *dst.BinaryExpr, isErr errMatcher, nilName string, yIsNil bool) bool {
+	ok := isErr(cond.X) && (cond.Op == token.EQL || cond.Op == token.NEQ)
+	if !ok {
+		return false
+	}
+	return (yIsNil && isName(cond.Y, nilName)) || (!yIsNil && !isName(cond.Y, nilName))
+}
+
+// moveStartDecs moves the leading space and comments of from to to.
+// It is used when a statement is inserted in front of another one, so that the comments stay on top.
+func moveStartDecs(from, to dst.Node) {
+	fd, td := from.Decorations(), to.Decorations()
+	td.Before, td.Start = fd.Before, fd.Start
+	fd.Before, fd.Start = dst.NewLine, nil
+}
+
+// declStmt returns the statement declaring the variables of spec.
+func declStmt(spec *dst.ValueSpec) *dst.DeclStmt {
+	return &dst.DeclStmt{Decl: &dst.GenDecl{Tok: token.VAR, Specs: []dst.Spec{spec}}}
+}
+
+// declaredNames returns the names that the statement declares in its block.
+func declaredNames(stmt dst.Stmt) []string {
+	var names []string
+	switch s := stmt.(type) {
+	case *dst.AssignStmt:
+		if s.Tok == token.DEFINE {
+			for _, e := range s.Lhs {
+				if id, ok := e.(*dst.Ident); ok {
+					names = append(names, id.Name)
+				}
+			}
+		}
+	case *dst.DeclStmt:
+		if d, ok := s.Decl.(*dst.GenDecl); ok {
+			for _, spec := range d.Specs {
+				switch spec := spec.(type) {
+				case *dst.ValueSpec:
+					for _, id := range spec.Names {
+						names = append(names, id.Name)
+					}
+				case *dst.TypeSpec:
+					names = append(names, spec.Name.Name)
+				}
+			}
+		}
+	case *dst.LabeledStmt:
+		return declaredNames(s.Stmt)
 	}
-	return re.MatchString(name)
+	return names
+}
+
+// countName returns the number of identifiers of n named name, leaving out the selected names of selectors.
+func countName(n dst.Node, name string) int {
+	count := 0
+	dst.Inspect(n, func(n dst.Node) bool {
+		switch n := n.(type) {
+		case *dst.SelectorExpr:
+			count += countName(n.X, name)
+			return false
+		case *dst.Ident:
+			if n.Name == name {
+				count++
+			}
+		}
+		return true
+	})
+	return count
 }
 
 // getImports returns a list of all imported packages in this file.
@@ -111,3 +180,68 @@ func isTopName(n dst.Expr, name string) bool {
 	id, ok := n.(*dst.Ident)
 	return ok && id.Name == name && id.Obj == nil
 }
+
+// exprString returns the source of simple expressions such as identifiers, selectors and types.
+// It returns an empty string for expressions it does not support.
+func exprString(n dst.Expr) string {
+	switch n := n.(type) {
+	case *dst.Ident:
+		return n.Name
+	case *dst.BasicLit:
+		return n.Value
+	case *dst.SelectorExpr:
+		return exprString(n.X) + "." + n.Sel.Name
+	case *dst.StarExpr:
+		return "*" + exprString(n.X)
+	case *dst.ParenExpr:
+		return "(" + exprString(n.X) + ")"
+	case *dst.Ellipsis:
+		return "..." + exprString(n.Elt)
+	case *dst.ArrayType:
+		if n.Len == nil {
+			return "[]" + exprString(n.Elt)
+		}
+		return "[" + exprString(n.Len) + "]" + exprString(n.Elt)
+	case *dst.MapType:
+		return "map[" + exprString(n.Key) + "]" + exprString(n.Value)
+	case *dst.ChanType:
+		return "chan " + exprString(n.Value)
+	case *dst.FuncType:
+		return "func" + funcSignature(n)
+	case *dst.InterfaceType:
+		if len(n.Methods.List) == 0 {
+			return "interface{}"
+		}
+	}
+	return ""
+}
+
+// funcSignature returns the parameter and result types of a function without their names,
+// such as "([]byte) (int, error)".
+func funcSignature(t *dst.FuncType) string {
+	fieldTypes := func(fl *dst.FieldList) []string {
+		var types []string
+		if fl == nil {
+			return types
+		}
+		for _, f := range fl.List {
+			s := exprString(f.Type)
+			types = append(types, s)
+			for i := 1; i < len(f.Names); i++ {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+
+	sig := "(" + strings.Join(fieldTypes(t.Params), ", ") + ")"
+	results := fieldTypes(t.Results)
+	switch len(results) {
+	case 0:
+	case 1:
+		sig += " " + results[0]
+	default:
+		sig += " (" + strings.Join(results, ", ") + ")"
+	}
+	return sig
+}
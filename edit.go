@@ -0,0 +1,285 @@
+package errfix
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Edit replaces a range of bytes of the original content of a file.
+type Edit struct {
+	// Rule is the name of the rule that made the edit. When several rules rewrote the same range, it is the first one.
+	// It is empty for edits that only follow from other edits, such as the changes of imports.
+	Rule string
+	// Pos and End delimit the replaced range of the original content. They are equal for insertions.
+	Pos, End token.Position
+	// OldText is the replaced range of the original content.
+	OldText string
+	// NewText replaces the range.
+	NewText string
+	// Message describes the rewrites of the edit.
+	Message string
+}
+
+// String returns the edit in the form "file:line:column: message (rule)".
+func (e Edit) String() string {
+	if e.Rule == "" {
+		return fmt.Sprintf("%s: %s", e.Pos, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.Pos, e.Message, e.Rule)
+}
+
+// ApplyEdits applies the edits to the content they were computed from.
+// The edits must not overlap.
+func ApplyEdits(content string, edits []Edit) (string, error) {
+	edits = append([]Edit(nil), edits...)
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].Pos.Offset < edits[j].Pos.Offset
+	})
+	var b strings.Builder
+	last := 0
+	for _, e := range edits {
+		if e.Pos.Offset < last || e.End.Offset < e.Pos.Offset || e.End.Offset > len(content) {
+			return "", fmt.Errorf("invalid edit at %s", e.Pos)
+		}
+		if content[e.Pos.Offset:e.End.Offset] != e.OldText {
+			return "", fmt.Errorf("edit at %s does not match the content", e.Pos)
+		}
+		b.WriteString(content[last:e.Pos.Offset])
+		b.WriteString(e.NewText)
+		last = e.End.Offset
+	}
+	b.WriteString(content[last:])
+	return b.String(), nil
+}
+
+// diffEdits returns the edits that turn a into b, the content of the file name.
+// Every edit is attributed to the rules that rewrote code in the lines it replaces,
+// and described by their descriptions.
+func diffEdits(name, a, b string, rewrites []rewrite, descriptions map[string]string) []Edit {
+	linesA, linesB := splitLines(a), splitLines(b)
+	offsets := make([]int, len(linesA)+1)
+	for i, line := range linesA {
+		offsets[i+1] = offsets[i] + len(line)
+	}
+	position := func(offset int) token.Position {
+		line := sort.SearchInts(offsets, offset+1) - 1
+		return token.Position{Filename: name, Offset: offset, Line: line + 1, Column: offset - offsets[line] + 1}
+	}
+
+	var edits []Edit
+	// add appends the edit that replaces the lines i1 to i2 of a by the lines j1 to j2 of b.
+	add := func(i1, i2, j1, j2 int) {
+		start, end := offsets[i1], offsets[i2]
+		oldText, newText := a[start:end], strings.Join(linesB[j1:j2], "")
+		// The hunk of lines is narrowed down to the bytes that changed.
+		prefix, suffix := commonAffixes(oldText, newText)
+		e := Edit{
+			Pos:     position(start + prefix),
+			End:     position(end - suffix),
+			OldText: oldText[prefix : len(oldText)-suffix],
+			NewText: newText[prefix : len(newText)-suffix],
+		}
+
+		// An insertion of lines is attributed to the line it is inserted before.
+		last := i2
+		if last == i1 {
+			last++
+		}
+		var rules, msgs []string
+		seen := map[string]bool{}
+		for _, r := range hunkRewrites(rewrites, i1+1, last) {
+			if !seen[r.rule] {
+				seen[r.rule] = true
+				rules = append(rules, r.rule)
+				msg := descriptions[r.rule]
+				if msg == "" {
+					msg = r.rule
+				}
+				msgs = append(msgs, msg)
+			}
+		}
+		if len(rules) > 0 {
+			e.Rule = rules[0]
+			e.Message = strings.Join(msgs, "; ")
+		} else {
+			e.Message = "update imports"
+		}
+		edits = append(edits, e)
+	}
+
+	m := difflib.NewMatcher(linesA, linesB)
+	for _, op := range m.GetOpCodes() {
+		switch {
+		case op.Tag == 'e':
+		case op.Tag == 'r' && op.I2-op.I1 == op.J2-op.J1:
+			// Lines replaced one for one are edited one by one, so that the rewrites of adjacent lines,
+			// possibly by different rules, get their own edits.
+			for k := 0; k < op.I2-op.I1; k++ {
+				if linesA[op.I1+k] != linesB[op.J1+k] {
+					add(op.I1+k, op.I1+k+1, op.J1+k, op.J1+k+1)
+				}
+			}
+		default:
+			add(op.I1, op.I2, op.J1, op.J2)
+		}
+	}
+	return edits
+}
+
+// hunkRewrites returns the rewrites that made the changes of the lines first to last of the original file.
+// They are the rewrites of the nodes that start in these lines. When there are none, the lines changed inside
+// of multi-line nodes, and they are the rewrites of the innermost nodes that span them.
+func hunkRewrites(rewrites []rewrite, first, last int) []rewrite {
+	var starting, spanning []rewrite
+	for _, r := range rewrites {
+		end := r.end.Line
+		if end < r.pos.Line {
+			end = r.pos.Line
+		}
+		switch {
+		case r.pos.Line >= first && r.pos.Line <= last:
+			starting = append(starting, r)
+		case r.pos.Line < first && end >= first:
+			if len(spanning) > 0 && spanning[0].pos.Offset < r.pos.Offset {
+				spanning = spanning[:0]
+			}
+			if len(spanning) == 0 || spanning[0].pos.Offset == r.pos.Offset {
+				spanning = append(spanning, r)
+			}
+		}
+	}
+	if len(starting) > 0 {
+		return starting
+	}
+	return spanning
+}
+
+// splitFixes splits the edits that turn a into b into fixes that give code that compiles when applied on their own.
+// Every fix starts with an edit of a rule, followed by the edits without a rule, such as the changes of imports,
+// when the edit of the rule uses a package whose import they change. Identical edits of several fixes are merged
+// when the fixes are applied together. The edits without a rule that no fix needs are returned apart.
+func splitFixes(a, b string, edits []Edit) (fixes [][]Edit, rest []Edit) {
+	var others []Edit
+	for _, e := range edits {
+		if e.Rule == "" {
+			others = append(others, e)
+		}
+	}
+	names := changedImports(a, b)
+	needed := false
+	for _, e := range edits {
+		if e.Rule == "" {
+			continue
+		}
+		fix := []Edit{e}
+		if len(others) > 0 && usesPackages(a, e, names) {
+			fix = append(fix, others...)
+			needed = true
+		}
+		fixes = append(fixes, fix)
+	}
+	if !needed {
+		rest = others
+	}
+	return fixes, rest
+}
+
+// changedImports returns the names of the packages that b imports under another path than a, or that a lacks.
+func changedImports(a, b string) map[string]bool {
+	importsA, importsB := fileImports(a), fileImports(b)
+	names := map[string]bool{}
+	for name, p := range importsB {
+		if importsA[name] != p {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// fileImports returns the paths of the packages imported by a file by name.
+func fileImports(content string) map[string]string {
+	imports := map[string]string{}
+	f, err := parser.ParseFile(token.NewFileSet(), "", content, parser.ImportsOnly)
+	if err != nil {
+		return imports
+	}
+	for _, s := range f.Imports {
+		p, err := strconv.Unquote(s.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := path.Base(p)
+		if s.Name != nil {
+			name = s.Name.Name
+		}
+		imports[name] = p
+	}
+	return imports
+}
+
+// usesPackages returns true when the new text of e, an edit of a, selects from one of the named packages.
+// The edit may start after the name of the package, which is then taken from a.
+func usesPackages(a string, e Edit, names map[string]bool) bool {
+	start := e.Pos.Offset
+	for start > 0 && (isWordByte(a[start-1]) || a[start-1] == '.') {
+		start--
+	}
+	text := a[start:e.Pos.Offset] + e.NewText
+	for i := 0; i < len(text); {
+		j := i
+		for j < len(text) && isWordByte(text[j]) {
+			j++
+		}
+		if j == i {
+			i++
+			continue
+		}
+		if j < len(text) && text[j] == '.' && (i == 0 || text[i-1] != '.') && names[text[i:j]] {
+			return true
+		}
+		i = j
+	}
+	return false
+}
+
+// commonAffixes returns the lengths of the common prefix and suffix of a and b, that do not overlap
+// and do not split identifiers or runes.
+func commonAffixes(a, b string) (int, int) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for prefix > 0 && isWordByte(a[prefix-1]) && (prefix < len(a) && isWordByte(a[prefix]) || prefix < len(b) && isWordByte(b[prefix])) {
+		prefix--
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && isWordByte(a[len(a)-suffix]) && (suffix < len(a) && isWordByte(a[len(a)-1-suffix]) || suffix < len(b) && isWordByte(b[len(b)-1-suffix])) {
+		suffix--
+	}
+	return prefix, suffix
+}
+
+// isWordByte returns true for the bytes of identifiers, including all the bytes of non-ASCII runes.
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= utf8.RuneSelf
+}
+
+// splitLines splits s after every newline, so that the lines add up to s.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -7,14 +7,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"go/ast"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
@@ -23,19 +28,35 @@ import (
 )
 
 // Reader is an interface that contains only one Read method.
+// Read sends the files on the returned channel and closes it at the end, or as soon as the context is done.
 type Reader interface {
 	Read(context.Context) (chan *File, error)
 }
 
 // NewReader returns a default Reader interface.
-// The parameter inputs can be *os.File, io.Reader, file path, directory path.
+// The parameter inputs can be *os.File, io.Reader, file path, directory path, Packages,
+// or a Go package pattern such as ./... or github.com/org/repo/pkg, which is read as Packages.
+// Inputs of type ReaderOption configure the reader instead.
 // When the wrong type is entered, an error will be thrown during actual reading.
 func NewReader(inputs ...interface{}) Reader {
-	return &reader{inputs: inputs}
+	r := &reader{}
+	for _, p := range inputs {
+		if opt, ok := p.(ReaderOption); ok {
+			opt(r)
+			continue
+		}
+		r.inputs = append(r.inputs, p)
+	}
+	return r
 }
 
 type reader struct {
-	inputs []interface{}
+	inputs    []interface{}
+	generated bool
+	include   []string
+	exclude   []string
+	gitignore bool
+	changes   *Changes
 }
 
 // Read returns a file channel when the call succeeds.
@@ -44,17 +65,29 @@ func (r *reader) Read(ctx context.Context) (chan *File, error) {
 	if len(r.inputs) == 0 {
 		return nil, errors.New("no source to read")
 	}
+	for _, pattern := range append(r.include[:len(r.include):len(r.include)], r.exclude...) {
+		if err := validGlob(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q, %v", pattern, err)
+		}
+	}
 	for _, p := range r.inputs {
 		switch p := p.(type) {
 		case *os.File:
 		case io.Reader:
+		case Packages:
+			if len(p.Patterns) == 0 {
+				return nil, errors.New("the input packages have no patterns")
+			}
 		case string:
+			if IsPattern(p) {
+				continue
+			}
 			_, err := os.Stat(p)
 			if err != nil {
 				return nil, fmt.Errorf("the input source is not a valid file or directory, %v", err)
 			}
 		default:
-			return nil, fmt.Errorf("the input source only supports *os.File, io.Reader and string")
+			return nil, fmt.Errorf("the input source only supports *os.File, io.Reader, Packages and string")
 		}
 	}
 
@@ -76,73 +109,169 @@ func (r *reader) read(ctx context.Context, ch chan *File) {
 	}
 
 	for _, p := range r.inputs {
+		var err error
 		switch p := p.(type) {
 		case *os.File:
-			content, err := io.ReadAll(p)
+			content, rerr := io.ReadAll(p)
 			f := &File{
 				Name:    formatName(p.Name()),
 				Content: string(content),
-				Error:   err,
+				Error:   rerr,
 			}
-			ch <- f
+			err = send(ctx, ch, f)
 		case io.Reader:
-			content, err := io.ReadAll(p)
+			content, rerr := io.ReadAll(p)
 			f := &File{
 				Name:    formatName("io.Reader"),
 				Content: string(content),
-				Error:   err,
+				Error:   rerr,
 			}
-			ch <- f
+			err = send(ctx, ch, f)
+		case Packages:
+			err = r.readPackages(ctx, ch, p)
 		case string:
-			fileInfo, err := os.Stat(p)
-			if err != nil {
+			if IsPattern(p) {
+				err = r.readPackages(ctx, ch, Packages{Patterns: []string{p}})
+				break
+			}
+			fileInfo, serr := os.Stat(p)
+			if serr != nil {
 				f := &File{
 					Name:    p,
 					Content: "",
-					Error:   err,
+					Error:   serr,
 				}
-				ch <- f
+				err = send(ctx, ch, f)
 			} else if fileInfo.IsDir() {
-				r.readDir(ctx, ch, p)
+				err = r.readDir(ctx, ch, p)
 			} else {
-				r.readPath(ctx, ch, p)
+				err = r.readPath(ctx, ch, p)
 			}
 		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// send sends f on ch, unless ctx is done first, so that the reader never blocks on a consumer that stopped.
+func send(ctx context.Context, ch chan *File, f *File) error {
+	select {
+	case ch <- f:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (r *reader) readPath(ctx context.Context, ch chan *File, p string) {
+func (r *reader) readPath(ctx context.Context, ch chan *File, p string) error {
 	isGoFile := strings.HasSuffix(p, ".go")
 	if !isGoFile {
-		return
+		return nil
+	}
+	if r.changes != nil && !r.changes.Changed(p) {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 	content, err := os.ReadFile(p)
+	if err == nil && !r.generated && isGenerated(string(content)) {
+		return nil
+	}
 	f := &File{
 		Name:    p,
 		Content: string(content),
 		Error:   err,
 	}
-	ch <- f
+	return send(ctx, ch, f)
 }
 
-func (r *reader) readDir(ctx context.Context, ch chan *File, dir string) {
+// readDir sends the go files of dir, but those that the include, exclude and .gitignore patterns leave out.
+// It returns an error only when ctx is done, which stops the walk.
+func (r *reader) readDir(ctx context.Context, ch chan *File, dir string) error {
+	var ignore *gitignore
+	if r.gitignore {
+		ignore = newGitignore(dir)
+	}
 	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		// The patterns do not apply to the directory given as input.
+		if p != dir {
+			skip := r.excluded(p)
+			if ignore != nil && !skip {
+				abs, _ := filepath.Abs(p)
+				skip = info.Name() == ".git" || ignore.ignored(abs, info.IsDir())
+			}
+			if skip && info.IsDir() {
+				return filepath.SkipDir
+			}
+			if skip {
+				return nil
+			}
+		}
 		if !info.IsDir() {
-			r.readPath(ctx, ch, p)
+			if !r.included(p) {
+				return nil
+			}
+			return r.readPath(ctx, ch, p)
 		}
-		return nil
+		if ignore != nil {
+			abs, _ := filepath.Abs(p)
+			ignore.load(abs)
+		}
+		return ctx.Err()
 	})
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		f := &File{
 			Name:    dir,
 			Content: "",
 			Error:   err,
 		}
-		ch <- f
+		return send(ctx, ch, f)
 	}
+	return nil
+}
+
+// readPackages sends the go files of the packages matched by the patterns of pkgs, after a failed file
+// for every package that cannot be loaded. It returns an error only when ctx is done.
+func (r *reader) readPackages(ctx context.Context, ch chan *File, pkgs Packages) error {
+	files, failures, err := pkgs.files(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		f := &File{
+			Name:    strings.Join(pkgs.Patterns, " "),
+			Content: "",
+			Error:   err,
+		}
+		return send(ctx, ch, f)
+	}
+	for _, pe := range failures {
+		f := &File{
+			Name:    pe.pkg,
+			Content: "",
+			Error:   pe.err,
+		}
+		if err := send(ctx, ch, f); err != nil {
+			return err
+		}
+	}
+	for _, name := range files {
+		if r.excluded(name) || !r.included(name) {
+			continue
+		}
+		if err := r.readPath(ctx, ch, name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Processor is an interface that only contains the Process method.
@@ -151,286 +280,382 @@ type Processor interface {
 	Process(context.Context, *File) (*File, error)
 }
 
-type processor struct {
-	fset *token.FileSet
-}
+// Mode selects the error package the built-in rules rewrite toward.
+type Mode int
 
-// NewProcessor returns a default Processor interface.
-func NewProcessor() Processor {
-	return &processor{fset: token.NewFileSet()}
+const (
+	// ModePkgErrors rewrites errors toward github.com/pkg/errors,
+	// using WithStack, Wrapf and Cause.
+	ModePkgErrors Mode = iota
+	// ModeStdErrors rewrites errors toward the standard library,
+	// using %w wrapping, errors.Is and errors.As.
+	ModeStdErrors
+)
+
+var modeNames = map[Mode]string{
+	ModePkgErrors: "pkg",
+	ModeStdErrors: "std",
 }
 
-// Process converts the input file into a new file with built-in rules.
-func (p *processor) Process(ctx context.Context, f *File) (*File, error) {
-	df, err := decorator.ParseFile(p.fset, f.Name, f.Content, parser.ParseComments)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing ast, %v", err)
+// String returns the name of the mode as accepted by ParseMode.
+func (m Mode) String() string {
+	if s, ok := modeNames[m]; ok {
+		return s
 	}
+	return "Mode(" + strconv.Itoa(int(m)) + ")"
+}
 
-	changed := false
-	dps := newDstProcessors()
-	for _, dp := range dps {
-		dst.Inspect(df, func(n dst.Node) bool {
-			err = dp.Process(ctx, n)
-			return err == nil
-		})
-		if err != nil {
-			return nil, fmt.Errorf("error while traversing ast, %v", err)
-		}
-		ok, err := dp.EndProcess(ctx, df)
-		if err != nil {
-			return nil, fmt.Errorf("error ending traversal of ast, %v", err)
+// ParseMode returns the mode with the given name, either "pkg" or "std".
+func ParseMode(s string) (Mode, error) {
+	for m, name := range modeNames {
+		if name == s {
+			return m, nil
 		}
-		changed = changed || ok
 	}
+	return 0, fmt.Errorf("unknown mode %q, expected pkg or std", s)
+}
 
-	if !changed {
-		f2 := &File{
-			Name:    f.Name,
-			Content: f.Content,
-			Error:   nil,
-		}
-		return f2, nil
+// MessageStyle selects how the rules write the messages of the errors they rewrite.
+type MessageStyle int
+
+const (
+	// MessageStyleKeep keeps messages as they are written.
+	MessageStyleKeep MessageStyle = iota
+	// MessageStyleLower follows the Go conventions for error strings:
+	// messages start with a lower-case letter, unless the first word is an acronym, and do not end with punctuation.
+	MessageStyleLower
+)
+
+var messageStyleNames = map[MessageStyle]string{
+	MessageStyleKeep:  "keep",
+	MessageStyleLower: "lower",
+}
+
+// String returns the name of the style as accepted by ParseMessageStyle.
+func (s MessageStyle) String() string {
+	if name, ok := messageStyleNames[s]; ok {
+		return name
 	}
+	return "MessageStyle(" + strconv.Itoa(int(s)) + ")"
+}
 
-	buf := &bytes.Buffer{}
-	err = decorator.Fprint(buf, df)
-	if err != nil {
-		return nil, fmt.Errorf("error while generating source code based on ast, %v", err)
+// ParseMessageStyle returns the message style with the given name, either "keep" or "lower".
+func ParseMessageStyle(s string) (MessageStyle, error) {
+	for style, name := range messageStyleNames {
+		if name == s {
+			return style, nil
+		}
 	}
+	return 0, fmt.Errorf("unknown message style %q, expected keep or lower", s)
+}
 
-	f2 := &File{
-		Name:    f.Name,
-		Content: buf.String(),
-		Error:   nil,
+// SplitList splits the comma-separated value of a flag such as -rules into its elements.
+// Spaces around the elements are trimmed, and empty elements are left out.
+func SplitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
 	}
-	return f2, nil
+	return list
 }
 
-type dstProcessor interface {
-	Process(context.Context, dst.Node) error
-	EndProcess(context.Context, *dst.File) (bool, error)
+// ProcessorOption configures the Processor returned by NewProcessor.
+type ProcessorOption func(*processor)
+
+// WithMode sets the error package the Processor rewrites toward. The default is ModePkgErrors.
+func WithMode(m Mode) ProcessorOption {
+	return func(p *processor) {
+		p.mode = m
+	}
 }
 
-type dstProcessors []dstProcessor
+// WithTypeCheck enables type-aware detection of errors.
+// The package of every file is loaded with the go toolchain, and instead of identifiers named err,
+// the rules rewrite identifiers whose type is error.
+func WithTypeCheck(enabled bool) ProcessorOption {
+	return func(p *processor) {
+		p.types = nil
+		if enabled {
+			p.types = newTypeChecker()
+		}
+	}
+}
 
-func newDstProcessors() dstProcessors {
-	return dstProcessors{newPkgErrorsDstProcessor()}
+// WithErrName sets the regular expression that the names of error variables must match.
+// The default is ^err$. With type checking enabled, errors of any name are rewritten unless a pattern is set.
+func WithErrName(re *regexp.Regexp) ProcessorOption {
+	return func(p *processor) {
+		p.errName = re
+	}
 }
 
-type pkgErrorsDstProcessor struct {
-	pkgPath        string
-	errorsIdent    string
-	withStackIdent string
-	causeIdent     string
-	newIdent       string
-	errorfIdent    string
-	wrapfIdent     string
-	errIdent       string
-	nilIdent       string
-	changed        bool
+// WithSentinels adds sentinel errors, such as "mypkg.ErrDone", to the ones that must stay unwrapped by contract.
+// Returns of an error that has just been compared with one of them are left as they are.
+// The default sentinels are listed in DefaultSentinels.
+func WithSentinels(names ...string) ProcessorOption {
+	return func(p *processor) {
+		for _, name := range names {
+			p.sentinels[name] = true
+		}
+	}
 }
 
-func newPkgErrorsDstProcessor() *pkgErrorsDstProcessor {
-	return &pkgErrorsDstProcessor{
-		pkgPath:        "github.com/pkg/errors",
-		errorsIdent:    "errors",
-		withStackIdent: "WithStack",
-		causeIdent:     "Cause",
-		newIdent:       "New",
-		errorfIdent:    "Errorf",
-		wrapfIdent:     "Wrapf",
-		errIdent:       "err",
-		nilIdent:       "nil",
+// WithStdSentinels enables rewriting package-level sentinels declared with fmt.Errorf and no arguments
+// into errors.New of the standard library. Package-level declarations are never converted
+// to stack-capturing constructors, with or without this option.
+func WithStdSentinels(enabled bool) ProcessorOption {
+	return func(p *processor) {
+		p.stdSentinels = enabled
 	}
 }
 
-func (p *pkgErrorsDstProcessor) Process(ctx context.Context, n dst.Node) (err error) {
-	changed := false
-	switch n := n.(type) {
-	case *dst.ReturnStmt:
-		changed = p.fixReturnStmt(n)
-	case *dst.IfStmt:
-		changed = p.fixIfStmt(n)
-	case *dst.TypeAssertExpr:
-		changed = p.fixTypeAssertExpr(n)
-	case *dst.CallExpr:
-		changed = p.fixCallExpr(n)
-	}
-	p.changed = p.changed || changed
-	return
-}
-
-func (p *pkgErrorsDstProcessor) EndProcess(ctx context.Context, f *dst.File) (bool, error) {
-	if !p.changed {
-		return false, nil
+// WithRuleSet replaces the built-in rules of the mode with the given rules, such as registered rules looked up by name.
+func WithRuleSet(rules ...NewRuleFunc) ProcessorOption {
+	return func(p *processor) {
+		p.ruleSet = rules
 	}
+}
 
-	imports := getImports(f)
-	imp := findImportByPath(imports, p.pkgPath)
-	if imp != nil {
-		return true, nil
+// WithMessageStyle sets the style of the messages of the errors the rules rewrite. The default is MessageStyleKeep.
+func WithMessageStyle(s MessageStyle) ProcessorOption {
+	return func(p *processor) {
+		p.messageStyle = s
 	}
+}
 
-	imp = findImportByPath(imports, "errors")
-	if imp != nil {
-		imp.Name = nil
-		imp.Path.Value = strconv.Quote(p.pkgPath)
-	} else {
-		addImport(f, p.pkgPath, "", imports)
+// WithRules adds rules that run on every file after the built-in rules of the mode, in the given order.
+// The rules do not need to be registered.
+func WithRules(rules ...NewRuleFunc) ProcessorOption {
+	return func(p *processor) {
+		p.extraRules = append(p.extraRules, rules...)
 	}
+}
 
-	return true, nil
+type processor struct {
+	fset           *token.FileSet
+	mode           Mode
+	types          *typeChecker
+	errName        *regexp.Regexp
+	sentinels      map[string]bool
+	stdSentinels   bool
+	messageStyle   MessageStyle
+	ruleSet        []NewRuleFunc
+	extraRules     []NewRuleFunc
+	rules          []NewRuleFunc
+	descriptions   map[string]string
+	changes        *Changes
+	baseline       *Baseline
+	baselineRecord *Baseline
+}
+
+// NewProcessor returns a default Processor interface.
+func NewProcessor(opts ...ProcessorOption) Processor {
+	return newProcessor(opts...)
 }
 
-func (p pkgErrorsDstProcessor) fixReturnStmt(n *dst.ReturnStmt) (changed bool) {
-	// return [..., ]err
-	// ->
-	// return [..., ]errors.WithStack(err)
-	if len(n.Results) == 0 {
-		return
+func newProcessor(opts ...ProcessorOption) *processor {
+	p := &processor{fset: token.NewFileSet(), sentinels: map[string]bool{}}
+	for _, name := range DefaultSentinels {
+		p.sentinels[name] = true
 	}
-	lastResult := &n.Results[len(n.Results)-1]
-	if !isName(*lastResult, p.errIdent) {
-		return
+	for _, opt := range opts {
+		opt(p)
 	}
-	*lastResult = &dst.CallExpr{
-		Fun: &dst.SelectorExpr{
-			X:   dst.NewIdent(p.errorsIdent),
-			Sel: dst.NewIdent(p.withStackIdent),
-		},
-		Args: []dst.Expr{dst.NewIdent(p.errIdent)},
+	if p.ruleSet == nil {
+		p.ruleSet = modeRules(p.mode)
 	}
-	return true
-}
-
-func (p pkgErrorsDstProcessor) fixIfStmt(n *dst.IfStmt) (changed bool) {
-	cond, ok := n.Cond.(*dst.BinaryExpr)
-	if !ok {
-		return
+	p.rules = append(p.ruleSet[:len(p.ruleSet):len(p.ruleSet)], p.extraRules...)
+	p.descriptions = map[string]string{}
+	for _, newRule := range p.rules {
+		r := newRule()
+		p.descriptions[r.Name()] = r.Description()
 	}
+	return p
+}
 
-	compareErr := func(cond *dst.BinaryExpr, yIsNil bool) bool {
-		ok := isName(cond.X, p.errIdent) && (cond.Op == token.EQL || cond.Op == token.NEQ)
-		if !ok {
-			return false
+// Process converts the input file into a new file with the built-in rules of the mode and the extra rules.
+func (p *processor) Process(ctx context.Context, f *File) (*File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var df *dst.File
+	var err error
+	ps := p.newPass(f)
+	if p.types != nil {
+		var info *types.Info
+		df, ps.dec, info, ps.notes, err = p.types.check(ctx, f)
+		if err != nil {
+			return nil, err
 		}
-		ok = (yIsNil && isName(cond.Y, p.nilIdent)) || (!yIsNil && !isName(cond.Y, p.nilIdent))
-		return ok
+		ps.isErr = typesErrMatcher(ps.dec, info, p.errName)
+	} else {
+		ps.dec = decorator.NewDecorator(p.fset)
+		df, err = ps.dec.ParseFile(f.Name, f.Content, parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ast, %v", err)
+		}
+		ps.isErr = p.nameErrMatcher()
 	}
+	return p.rewrite(ctx, f, df, ps)
+}
 
-	// if stmt; err == something-but-not-nil
-	// ->
-	// if stmt; errors.Cause(err) == something-but-not-nil
-	if compareErr(cond, false) {
-		cond.X = p.causeExpr()
-		return true
+// processAST converts a file that has already been parsed, and type checked when info is not nil,
+// such as the files given to an analysis pass. The content of f must be the source of af.
+func (p *processor) processAST(ctx context.Context, f *File, fset *token.FileSet, af *ast.File, info *types.Info) (*File, error) {
+	ps := p.newPass(f)
+	ps.dec = decorator.NewDecorator(fset)
+	df, err := ps.dec.DecorateFile(af)
+	if err != nil {
+		return nil, fmt.Errorf("error decorating ast, %v", err)
 	}
-	// if stmt; err != nil && err != something-but-not-nil
-	// ->
-	// if stmt; err != nil && errors.Cause(err) != something-but-not-nil
-	condX, okX := cond.X.(*dst.BinaryExpr)
-	condY, okY := cond.Y.(*dst.BinaryExpr)
-	ok = (cond.Op == token.LAND || cond.Op == token.LOR) &&
-		(okX && compareErr(condX, true)) &&
-		(okY && compareErr(condY, false))
-	if ok {
-		condY.X = p.causeExpr()
-		return true
+	if p.types != nil && info != nil {
+		ps.isErr = typesErrMatcher(ps.dec, info, p.errName)
+	} else {
+		ps.isErr = p.nameErrMatcher()
 	}
+	return p.rewrite(ctx, f, df, ps)
+}
 
-	return
+func (p *processor) newPass(f *File) *Pass {
+	ps := &Pass{sentinels: p.sentinels, stdSentinels: p.stdSentinels, messageStyle: p.messageStyle}
+	ps.fileName, ps.content = f.Name, f.Content
+	if abs, err := filepath.Abs(f.Name); err == nil {
+		ps.fileName = abs
+	}
+	ps.baseline, ps.baselineRecord = p.baseline, p.baselineRecord
+	ps.baselineUsed = map[baselineKey]int{}
+	ps.checked = map[dst.Node]rewrite{}
+	ps.answered = map[ignoreCall]bool{}
+	if p.changes != nil {
+		ps.changesOnly = true
+		ps.changed = p.changes.Lines(f.Name)
+	}
+	return ps
 }
 
-func (p pkgErrorsDstProcessor) fixTypeAssertExpr(n *dst.TypeAssertExpr) (changed bool) {
-	ok := isName(n.X, p.errIdent)
-	if !ok {
-		return
+// nameErrMatcher returns the errMatcher used without type information.
+func (p *processor) nameErrMatcher() errMatcher {
+	errName := p.errName
+	if errName == nil {
+		errName = defaultErrName
 	}
-	n.X = p.causeExpr()
-	return true
+	return nameErrMatcher(errName)
 }
 
-func (p pkgErrorsDstProcessor) fixCallExpr(n *dst.CallExpr) (changed bool) {
-	if isPkgSelector(n.Fun, p.errorsIdent, p.newIdent) {
-		return true
-	}
-	if isPkgSelector(n.Fun, "fmt", "Errorf") {
-		if len(n.Args) == 0 {
-			return
+// rewrite runs the rules on the decorated file df, parsed from the content of f, and returns the result.
+func (p *processor) rewrite(ctx context.Context, f *File, df *dst.File, ps *Pass) (*File, error) {
+	var err error
+	ps.file = df
+	ps.topLevel = topLevelNodes(df)
+	ps.stdNews = stdSentinelNews(df, ps.topLevel)
+	ps.imports = map[string]string{}
+	for _, imp := range getImports(df) {
+		for _, spec := range imp.Specs {
+			ps.imports[importPath(spec.(*dst.ImportSpec))] = importName(spec.(*dst.ImportSpec))
 		}
-		lit, ok := n.Args[0].(*dst.BasicLit)
-		if !ok || lit.Kind != token.STRING {
-			return
+	}
+	ps.findIgnores(df)
+
+	changed := false
+	for _, newRule := range p.rules {
+		r := newRule()
+		ps.rule = r.Name()
+		ps.scopeIgnores(df)
+		dst.Inspect(df, func(n dst.Node) bool {
+			err = ctx.Err()
+			if err == nil {
+				err = r.Process(ctx, ps, n)
+			}
+			return err == nil
+		})
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		format, err := strconv.Unquote(lit.Value)
 		if err != nil {
-			return
+			return nil, fmt.Errorf("error while traversing ast with rule %s, %v", r.Name(), err)
 		}
-		ok = len(n.Args) >= 2 && isName(n.Args[len(n.Args)-1], p.errIdent) &&
-			(strings.HasSuffix(format, "%v"))
-		if ok {
-			// fmt.Errorf("format: %v", args..., err) ->
-			// errors.Wrapf(err, "format", args...)
-			newFormat := strings.TrimRight(format[0:len(format)-len("%v")], ` :,`)
-			newArgs := []dst.Expr{
-				n.Args[len(n.Args)-1],
-				&dst.BasicLit{
-					Kind:  token.STRING,
-					Value: fmt.Sprintf("%q", newFormat),
-				},
-			}
-			newArgs = append(newArgs, n.Args[1:len(n.Args)-1]...)
-			n.Args = newArgs
-			n.Fun = &dst.SelectorExpr{
-				X:   dst.NewIdent(p.errorsIdent),
-				Sel: dst.NewIdent(p.wrapfIdent),
-			}
-			return true
+		ok, err := r.EndProcess(ctx, ps, df)
+		if err != nil {
+			return nil, fmt.Errorf("error ending traversal of ast with rule %s, %v", r.Name(), err)
 		}
-		// fmt.Errorf("foo %s", x) ->
-		// errors.Errorf("foo %s", x)
-		n.Fun = &dst.SelectorExpr{
-			X:   dst.NewIdent(p.errorsIdent),
-			Sel: dst.NewIdent(p.errorfIdent),
+		changed = changed || ok
+	}
+	// Sentinels are pointed to the standard library once all rules have settled the imports.
+	fixStdErrorsSelectors(df, ps.stdNews)
+	ps.noteUnusedIgnores()
+
+	if !changed {
+		f2 := &File{
+			Name:    f.Name,
+			Content: f.Content,
+			Notes:   ps.notes,
+			Error:   nil,
 		}
-		return true
+		return f2, nil
+	}
+
+	buf := &bytes.Buffer{}
+	err = decorator.Fprint(buf, df)
+	if err != nil {
+		return nil, fmt.Errorf("error while generating source code based on ast, %v", err)
 	}
-	return
-}
 
-func (p pkgErrorsDstProcessor) causeExpr() *dst.CallExpr {
-	return &dst.CallExpr{
-		Fun: &dst.SelectorExpr{
-			X:   dst.NewIdent(p.errorsIdent),
-			Sel: dst.NewIdent(p.causeIdent),
-		},
-		Args: []dst.Expr{dst.NewIdent(p.errIdent)},
+	f2 := &File{
+		Name:     f.Name,
+		Content:  buf.String(),
+		Notes:    ps.notes,
+		Edits:    diffEdits(f.Name, f.Content, buf.String(), ps.rewrites, p.descriptions),
+		Rewrites: map[string]int{},
+		Error:    nil,
 	}
+	for _, r := range ps.rewrites {
+		f2.Rewrites[r.rule]++
+	}
+	return f2, nil
 }
 
 // Writer is an interface that contains only one Write method.
+// It receives the original file and the processed file, whose Edits list the rewrites with their rules,
+// so that writers can report or apply them without diffing the contents.
+// The writers of this package take a write parameter that makes them overwrite the files that change with their
+// new content, so that the rewrites are applied as well as reported.
 type Writer interface {
 	Write(context.Context, *File, *File) error
 }
 
 // DiffWriter implements the Writer interface, and it can generate diffs of old and new files.
 type DiffWriter struct {
-	write bool
-	buf   bytes.Buffer
-	mu    sync.Mutex
+	writeThrough
+	out     io.Writer
+	diffs   []fileDiff
+	changed bool
+	notes   []Note
+	mu      sync.Mutex
+}
+
+type fileDiff struct {
+	name string
+	text string
 }
 
-// NewDiffWriter returns a DiffWriter structure.
+// NewDiffWriter returns a DiffWriter structure that holds the diffs until DiffString is called.
 // When write is true and if there is a difference between the old and new files,
 // then the content of the new file will overwrite the content of the old file.
 func NewDiffWriter(write bool) *DiffWriter {
-	return &DiffWriter{write: write}
+	return &DiffWriter{writeThrough: writeThrough{write}}
+}
+
+// NewStreamDiffWriter returns a DiffWriter structure that writes every diff to out as soon as it is generated,
+// in the order the files are written, instead of holding them. It suits runs over many files.
+func NewStreamDiffWriter(out io.Writer, write bool) *DiffWriter {
+	return &DiffWriter{writeThrough: writeThrough{write}, out: out}
 }
 
-// Write writes the difference between the contents of two files to the buffer,
+// Write generates the difference between the contents of two files,
 // and overwrites the old file with the new file when needed.
-// If Write is called multiple times, the difference is appended to the buffer without clearing.
+// If Write is called multiple times, the differences add up without clearing.
 func (w *DiffWriter) Write(ctx context.Context, f *File, f2 *File) error {
 	diff := difflib.UnifiedDiff{
 		A:        difflib.SplitLines(f.Content),
@@ -444,67 +669,257 @@ func (w *DiffWriter) Write(ctx context.Context, f *File, f2 *File) error {
 		return fmt.Errorf("error while generating diff, %v", err)
 	}
 	w.mu.Lock()
-	w.buf.WriteString(text)
+	w.changed = w.changed || text != ""
+	w.notes = append(w.notes, f2.Notes...)
+	if w.out == nil {
+		w.diffs = append(w.diffs, fileDiff{name: f.Name, text: text})
+	} else if text != "" {
+		_, err = io.WriteString(w.out, text)
+	}
 	w.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error while writing diff, %v", err)
+	}
 
-	if text != "" && w.write {
-		fi, err := os.Stat(f.Name)
-		if err == nil && !fi.IsDir() {
-			return os.WriteFile(f.Name, []byte(f2.Content), 0)
-		}
+	_, err = w.overwrite(f, f2)
+	return err
+}
+
+// writeThrough is embedded by the writers that can overwrite the files they are given with their new content,
+// applying the rewrites while they report them.
+type writeThrough struct {
+	// write enables the overwriting of the files.
+	write bool
+}
+
+// overwrite overwrites the old file with the content of the new one, when writing is enabled and the content changes.
+// It returns true when the file was written, which it is not when it is not on disk, such as stdin.
+func (t writeThrough) overwrite(f *File, f2 *File) (bool, error) {
+	if !t.write || f.Content == f2.Content {
+		return false, nil
 	}
+	return writeFile(f, f2)
+}
 
-	return nil
+// writeFile overwrites the old file with the new content, applying the edits when there are some.
+// It returns false when the old file is not on disk, such as stdin.
+func writeFile(f *File, f2 *File) (bool, error) {
+	fi, err := os.Stat(f.Name)
+	if err != nil || fi.IsDir() {
+		return false, nil
+	}
+	content := f2.Content
+	if len(f2.Edits) > 0 {
+		content, err = ApplyEdits(f.Content, f2.Edits)
+		if err != nil {
+			return false, fmt.Errorf("error while applying edits to %s, %v", f.Name, err)
+		}
+	}
+	err = os.WriteFile(f.Name, []byte(content), 0)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// DiffString returns the differences of files currently held in the buffer.
+// DiffString returns the differences of files held so far, ordered by file name,
+// so that the output does not depend on the order in which the files were processed.
+// It is empty for a DiffWriter created by NewStreamDiffWriter.
 func (w *DiffWriter) DiffString() string {
-	return w.buf.String()
+	w.mu.Lock()
+	diffs := append([]fileDiff(nil), w.diffs...)
+	w.mu.Unlock()
+	sort.SliceStable(diffs, func(i, j int) bool {
+		return diffs[i].name < diffs[j].name
+	})
+	var b strings.Builder
+	for _, d := range diffs {
+		b.WriteString(d.text)
+	}
+	return b.String()
+}
+
+// Changed returns true when one of the files written so far has a difference.
+func (w *DiffWriter) Changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.changed
+}
+
+// Notes returns the notes of the files written so far.
+func (w *DiffWriter) Notes() []Note {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Note(nil), w.notes...)
 }
 
 // File represents a go file. The Error field will be set when an error occurs while reading or processing the file.
+// The Notes field explains the places that the rules left unchanged on purpose.
+// The Edits field of a processed file lists the edits that turn the original content into Content.
 type File struct {
 	Name    string
 	Content string
-	Error   error
+	Notes   []Note
+	Edits   []Edit
+	// Rewrites counts the rewrites of the rules by name, as an edit may hold several of them.
+	Rewrites map[string]int
+	Error    error
+}
+
+// Note explains why a rule left a piece of code unchanged.
+type Note struct {
+	Pos     token.Position
+	Rule    string
+	Message string
+}
+
+// String returns the note in the form "file:line:column: message (rule)".
+func (n Note) String() string {
+	return fmt.Sprintf("%s: %s (%s)", n.Pos, n.Message, n.Rule)
+}
+
+// The operations of ErrFix.Process that can fail on a file.
+const (
+	OpRead    = "read"
+	OpProcess = "process"
+	OpWrite   = "write"
+)
+
+// FileError is the failure of an operation of ErrFix.Process on a file.
+type FileError struct {
+	Name string
+	// Op is OpRead, OpProcess or OpWrite.
+	Op  string
+	Err error
+}
+
+func (e *FileError) Error() string {
+	switch e.Op {
+	case OpRead:
+		return fmt.Sprintf("error while reading from %s, %v", e.Name, e.Err)
+	case OpWrite:
+		return fmt.Sprintf("error while writing %s, %v", e.Name, e.Err)
+	}
+	return fmt.Sprintf("error while processing %s, %v", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// FileErrors are the failures of all the files of ErrFix.Process in keep-going mode, ordered by file name.
+type FileErrors []*FileError
+
+func (errs FileErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
 }
 
 // ErrFix converts a simple go error into an error carrying contextual information such as the call stack.
 type ErrFix struct {
-	r Reader
-	p Processor
-	w Writer
+	r         Reader
+	p         Processor
+	w         Writer
+	keepGoing bool
+	timeout   time.Duration
+}
+
+// ErrFixOption is an option of NewErrFix.
+type ErrFixOption func(*ErrFix)
+
+// WithKeepGoing processes all the files even when some of them fail, and returns the failures together
+// as FileErrors at the end. By default, Process stops at the first failure and cancels the outstanding work.
+func WithKeepGoing(keepGoing bool) ErrFixOption {
+	return func(e *ErrFix) {
+		e.keepGoing = keepGoing
+	}
+}
+
+// WithFileTimeout limits the time to process every file, so that a pathological file cannot hang the run.
+// A file that takes longer fails with context.DeadlineExceeded, even when the Processor does not check its context.
+// Zero means no limit.
+func WithFileTimeout(d time.Duration) ErrFixOption {
+	return func(e *ErrFix) {
+		e.timeout = d
+	}
 }
 
 // NewErrFix returns an ErrFix instance.
-func NewErrFix(r Reader, p Processor, w Writer) *ErrFix {
-	return &ErrFix{r: r, p: p, w: w}
+func NewErrFix(r Reader, p Processor, w Writer, opts ...ErrFixOption) *ErrFix {
+	e := &ErrFix{r: r, p: p, w: w}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
 }
 
 // Process will read all the files and then process the files and finally write the files to the buffer
 // (or directly overwrite the original files).
+// The failure of a file is returned as a *FileError, or all of them as FileErrors in keep-going mode.
+// When ctx is done, Process stops reading and processing files, and returns ctx.Err().
 func (e *ErrFix) Process(ctx context.Context) error {
+	parent := ctx
+	wg, ctx := errgroup.WithContext(ctx)
+	wg.SetLimit(8)
 	ch, err := e.r.Read(ctx)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		// The context of the group is done once Process returns, which stops the reader.
+		// The channel is drained in case the reader is blocked on a file that will never be processed.
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+
+	var mu sync.Mutex
+	var errs FileErrors
+	// fail returns the failure of a file to stop the group, or records it in keep-going mode.
+	fail := func(fe *FileError) error {
+		if !e.keepGoing {
+			return fe
+		}
+		mu.Lock()
+		errs = append(errs, fe)
+		mu.Unlock()
+		return nil
+	}
 
-	fn := func(f *File) error {
+	// Files are processed concurrently, but written in the order they are read,
+	// so that the output does not depend on which goroutine finishes first.
+	ow := &orderedWriter{w: e.w, fail: fail, pending: map[int][2]*File{}}
+	fn := func(i int, f *File) error {
+		var f2 *File
+		var fe *FileError
 		if f.Error != nil {
-			return fmt.Errorf("error while reading from %s, %v", f.Name, f.Error)
+			fe = &FileError{Name: f.Name, Op: OpRead, Err: f.Error}
+		} else {
+			var err error
+			f2, err = e.process(ctx, f)
+			if err != nil {
+				if parent.Err() != nil {
+					return parent.Err()
+				}
+				fe = &FileError{Name: f.Name, Op: OpProcess, Err: err}
+			}
 		}
-		f2, err := e.p.Process(ctx, f)
-		if err != nil {
-			return err
+		if fe != nil {
+			if err := fail(fe); err != nil {
+				return err
+			}
+			// The file is skipped, so that the files read after it are not held forever.
+			return ow.write(ctx, i, f, nil)
 		}
-		err = e.w.Write(ctx, f, f2)
-		return err
+		return ow.write(ctx, i, f, f2)
 	}
 
-	wg := &errgroup.Group{}
-	wg.SetLimit(8)
-	errCh := make(chan error, 1)
-
+	i := 0
 LOOP:
 	for {
 		select {
@@ -512,16 +927,91 @@ LOOP:
 			if !ok {
 				break LOOP
 			}
+			n := i
+			i++
 			wg.Go(func() error {
-				return fn(f)
+				return fn(n, f)
 			})
-		case err = <-errCh:
+		case <-ctx.Done():
 			break LOOP
 		}
 	}
+
+	err = wg.Wait()
+	// Failures that follow from the cancellation of the caller are not reported file by file.
+	if parent.Err() != nil {
+		return parent.Err()
+	}
 	if err != nil {
 		return err
 	}
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			return errs[i].Name < errs[j].Name
+		})
+		return errs
+	}
+	return nil
+}
+
+// process processes a file within the timeout of a file.
+// Processors cannot be interrupted everywhere, such as while type checking, so the file is processed in a goroutine
+// that is left to finish on its own when the timeout expires.
+func (e *ErrFix) process(ctx context.Context, f *File) (*File, error) {
+	if e.timeout <= 0 {
+		return e.p.Process(ctx, f)
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
 
-	return wg.Wait()
+	type result struct {
+		f   *File
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		f2, err := e.p.Process(ctx, f)
+		ch <- result{f2, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.f, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// orderedWriter writes the files of ErrFix.Process in the order they are read.
+// A processed file waits until all the files read before it have been written or skipped.
+type orderedWriter struct {
+	w       Writer
+	fail    func(*FileError) error
+	mu      sync.Mutex
+	next    int
+	pending map[int][2]*File
+}
+
+// write writes the file of index i once its turn comes. A nil f2 skips the file.
+func (o *orderedWriter) write(ctx context.Context, i int, f *File, f2 *File) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending[i] = [2]*File{f, f2}
+	for {
+		files, ok := o.pending[o.next]
+		if !ok {
+			return nil
+		}
+		delete(o.pending, o.next)
+		o.next++
+		if files[1] == nil {
+			continue
+		}
+		err := o.w.Write(ctx, files[0], files[1])
+		if err != nil {
+			err = o.fail(&FileError{Name: files[0].Name, Op: OpWrite, Err: err})
+			if err != nil {
+				return err
+			}
+		}
+	}
 }
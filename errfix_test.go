@@ -1,10 +1,28 @@
 package errfix
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dave/dst"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/analysistest"
 )
 
 func TestErrFix(t *testing.T) {
@@ -19,284 +37,926 @@ func TestErrFix(t *testing.T) {
 
 }
 
-type normalCase struct {
-	Name   string
-	Desc   string
-	Input  string
-	Output string
+func TestErrFixEdits(t *testing.T) {
+	modeCases := map[Mode][]normalCase{ModePkgErrors: testNormalCases, ModeStdErrors: testStdCases}
+	for mode, cases := range modeCases {
+		for _, c := range cases {
+			p := NewProcessor(WithMode(mode))
+			f := &File{Name: c.Name, Content: c.Input}
+			f2, err := p.Process(context.Background(), f)
+			msg := c.Name + " " + c.Desc
+			require.Nil(t, err, msg)
+			content, err := ApplyEdits(c.Input, f2.Edits)
+			require.Nil(t, err, msg)
+			require.Equal(t, f2.Content, content, msg)
+		}
+	}
+
+	input := `package foo
+
+func foo() error {
+	return err
 }
+`
+	f2, err := NewProcessor().Process(context.Background(), &File{Name: "foo.go", Content: input})
+	require.Nil(t, err)
+	require.Len(t, f2.Edits, 2)
+	e := f2.Edits[1]
+	require.Equal(t, "withstack", e.Rule)
+	require.Equal(t, "err", e.OldText)
+	require.Equal(t, "errors.WithStack(err)", e.NewText)
+	require.Equal(t, 4, e.Pos.Line)
+	require.Equal(t, 9, e.Pos.Column)
+	require.Equal(t, 12, e.End.Column)
+	require.Equal(t, "foo.go:4:9: wrap returned errors with errors.WithStack (withstack)", e.String())
+	require.Equal(t, "", f2.Edits[0].Rule)
 
-var testNormalCases = []normalCase{
-	{
-		"Unchanged #1",
-		"a simple empty function",
-		`package foo
+	// Rewrites of adjacent lines by different rules get their own edits.
+	input = `package foo
 
-func foo() {
+func foo() error {
+	if err != nil && err != ErrX {
+		return err
+	}
+	return nil
+}
+`
+	f2, err = NewProcessor().Process(context.Background(), &File{Name: "foo.go", Content: input})
+	require.Nil(t, err)
+	require.Len(t, f2.Edits, 3)
+	require.Equal(t, "", f2.Edits[0].Rule)
+	require.Equal(t, "cause", f2.Edits[1].Rule)
+	require.Equal(t, 4, f2.Edits[1].Pos.Line)
+	require.Equal(t, "withstack", f2.Edits[2].Rule)
+	require.Equal(t, 5, f2.Edits[2].Pos.Line)
+
+	// Multi-line statements whose changes are in later lines are attributed to the rules that rewrote them.
+	input = `package foo
 
+func foo() (*T, error) {
+	return &T{
+		A: 1,
+	}, err
 }
-`,
-		`package foo
 
-func foo() {
+func bar(name string) error {
+	return fmt.Errorf(
+		"open %s: %v",
+		name, err)
+}
+`
+	f2, err = NewProcessor().Process(context.Background(), &File{Name: "foo.go", Content: input})
+	require.Nil(t, err)
+	var rules []string
+	for _, e := range f2.Edits {
+		if e.Pos.Line > 3 {
+			rules = append(rules, e.Rule)
+		}
+	}
+	require.Equal(t, []string{"withstack", "wrapf"}, rules)
+	require.Equal(t, 6, f2.Edits[1].Pos.Line)
+	require.Equal(t, "errors.WithStack(err)", f2.Edits[1].NewText)
+}
 
+func TestErrFixStdErrors(t *testing.T) {
+	for _, c := range testStdCases {
+		p := NewProcessor(WithMode(ModeStdErrors))
+		f := &File{Name: c.Name, Content: c.Input}
+		f2, err := p.Process(context.Background(), f)
+		msg := c.Name + " " + c.Desc
+		require.Nil(t, err, msg)
+		require.Equal(t, c.Output, f2.Content, msg)
+	}
 }
-`,
-	},
-	{
-		"Comment#1",
-		"the function foo has a comment inside",
-		`package foo
 
-func foo() error {
-	var err error
-	// Comment A
-	if err != nil {
-		// Comment B
-		return err
+func TestErrFixTypeCheck(t *testing.T) {
+	name := "testdata/types/types.go"
+	content, err := os.ReadFile(name)
+	require.Nil(t, err)
+
+	p := NewProcessor(WithTypeCheck(true))
+	f2, err := p.Process(context.Background(), &File{Name: name, Content: string(content)})
+	require.Nil(t, err)
+	require.Equal(t, `package types
+
+import (
+	"github.com/pkg/errors"
+	"os"
+)
+
+func open(name string) (*os.File, error) {
+	f, dbErr := os.Open(name)
+	if dbErr != nil {
+		return nil, errors.WithStack(dbErr)
 	}
-	// Comment C
+	if e := check(f); e != nil {
+		return nil, errors.WithStack(e)
+	}
+	return f, nil
+}
+
+func describe(err string) string {
 	return err
 }
-`,
-		`package foo
+`, f2.Content)
+
+	f := &File{Name: "io.Reader", Content: `package foo
+
+func foo(err string, e error) (string, error) {
+	return err, e
+}
+`}
+	f2, err = p.Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Equal(t, `package foo
 
 import (
 	"github.com/pkg/errors"
 )
 
-func foo() error {
-	var err error
-	// Comment A
-	if err != nil {
-		// Comment B
-		return errors.WithStack(err)
+func foo(err string, e error) (string, error) {
+	return err, errors.WithStack(e)
+}
+`, f2.Content)
+
+	// Files that are not on disk, such as /dev/stdin, are checked on their own
+	// instead of failing to load the package of their directory.
+	f.Name = "/dev/foo.go"
+	f2, err = p.Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Contains(t, f2.Content, "return err, errors.WithStack(e)")
+
+	// Package-level sentinels are not errors to rewrite, even on the left of comparisons.
+	sentinel := `package foo
+
+import "errors"
+
+var ErrX = errors.New("x")
+
+func foo(dbErr error) bool {
+	if ErrX == dbErr {
+		return true
 	}
-	// Comment C
-	return errors.WithStack(err)
+	return ErrX != dbErr
 }
-`,
-	},
+`
+	f2, err = p.Process(context.Background(), &File{Name: "io.Reader", Content: sentinel})
+	require.Nil(t, err)
+	require.Equal(t, sentinel, f2.Content)
+	f2, err = NewProcessor(WithTypeCheck(true), WithMode(ModeStdErrors)).Process(context.Background(), &File{Name: "io.Reader", Content: sentinel})
+	require.Nil(t, err)
+	require.Equal(t, sentinel, f2.Content)
 
-	{
-		"WithStack#1",
-		"a function foo which returns error",
-		`package main
+	// The packages are loaded from their module, and the failures to import a package are reported.
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/foo\n\ngo 1.18\n"), 0644))
+	name = filepath.Join(dir, "foo.go")
+	input := "package foo\n\nimport \"example.com/missing\"\n\nfunc foo() error {\n\te := missing.Do()\n\treturn e\n}\n"
+	require.Nil(t, os.WriteFile(name, []byte(input), 0644))
+	f2, err = p.Process(context.Background(), &File{Name: name, Content: input})
+	require.Nil(t, err)
+	require.NotEmpty(t, f2.Notes)
+	require.Equal(t, "types", f2.Notes[0].Rule)
+	require.Equal(t, 3, f2.Notes[0].Pos.Line)
+	require.Contains(t, f2.Notes[0].Message, "example.com/missing")
 
-func main() {
+	// The notes name the file as it was given, like those of the other rules.
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	rel, err := filepath.Rel(wd, name)
+	require.Nil(t, err)
+	f2, err = NewProcessor(WithTypeCheck(true)).Process(context.Background(), &File{Name: rel, Content: input})
+	require.Nil(t, err)
+	require.NotEmpty(t, f2.Notes)
+	require.Equal(t, rel, f2.Notes[0].Pos.Filename)
+}
+
+func TestErrFixErrName(t *testing.T) {
+	p := NewProcessor(WithErrName(regexp.MustCompile(`^(err|.*Err|cerr)$`)))
+	f := &File{Name: "ErrName", Content: `package foo
 
+func foo() (int, error) {
+	n, readErr := read()
+	if readErr != nil {
+		return n, readErr
+	}
+	if closeErr := close(); closeErr != ErrClosed {
+		return 0, fmt.Errorf("close: %v", closeErr)
+	}
+	if e, ok := cerr.(CustomError); ok {
+		return 0, e
+	}
+	return n, nil
 }
+`}
+	f2, err := p.Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Equal(t, `package foo
 
-func foo() error {
-	var err error
+import (
+	"github.com/pkg/errors"
+)
+
+func foo() (int, error) {
+	n, readErr := read()
+	if readErr != nil {
+		return n, errors.WithStack(readErr)
+	}
+	if closeErr := close(); errors.Cause(closeErr) != ErrClosed {
+		return 0, errors.Wrapf(closeErr, "close")
+	}
+	if e, ok := errors.Cause(cerr).(CustomError); ok {
+		return 0, e
+	}
+	return n, nil
+}
+`, f2.Content)
+}
+
+func TestErrFixContracts(t *testing.T) {
+	p := NewProcessor(WithSentinels("ErrDone"))
+	f := &File{Name: "contract.go", Content: `package foo
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	return n, err
+}
+
+func (r *reader) Next() error {
+	err := r.next()
+	if err == sql.ErrNoRows || err == ErrDone {
+		return err
+	}
+	switch err {
+	case io.EOF:
+		return err
+	case ErrNotFound:
+		return err
+	}
 	return err
 }
-`,
-		`package main
+
+var split = func(data []byte, atEOF bool) (int, []byte, error) {
+	err := scan(data)
+	return 0, nil, err
+}
+`}
+	f2, err := p.Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Equal(t, `package foo
 
 import (
 	"github.com/pkg/errors"
 )
 
-func main() {
-
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	return n, err
 }
 
-func foo() error {
-	var err error
+func (r *reader) Next() error {
+	err := r.next()
+	if err == sql.ErrNoRows || err == ErrDone {
+		return err
+	}
+	switch errors.Cause(err) {
+	case io.EOF:
+		return err
+	case ErrNotFound:
+		return errors.WithStack(err)
+	}
 	return errors.WithStack(err)
 }
-`,
-	},
-	{
-		"WithStack#2",
-		"replace the errors package with github.com/pkg/errors",
-		`package foo
+
+var split = func(data []byte, atEOF bool) (int, []byte, error) {
+	err := scan(data)
+	return 0, nil, err
+}
+`, f2.Content)
+
+	var notes []string
+	for _, n := range f2.Notes {
+		notes = append(notes, n.String())
+	}
+	require.Equal(t, []string{
+		"contract.go:5:2: return left unwrapped: Read implements io.Reader, whose callers compare the returned error with == (withstack)",
+		"contract.go:11:3: return left unwrapped: err is sql.ErrNoRows or ErrDone, which callers compare with == (withstack)",
+		"contract.go:15:3: return left unwrapped: err is io.EOF, which callers compare with == (withstack)",
+		"contract.go:24:2: return left unwrapped: the function implements bufio.SplitFunc, whose callers compare the returned error with == (withstack)",
+	}, notes)
+}
+
+func TestErrFixStdSentinels(t *testing.T) {
+	cases := []struct {
+		mode   Mode
+		input  string
+		output string
+	}{
+		{
+			ModePkgErrors,
+			`package foo
 
 import (
-	"bar"
 	"errors"
 )
 
+var ErrNotFound = errors.New("not found")
+var ErrExists = fmt.Errorf("exists, 100%%")
+var ErrInvalid = fmt.Errorf("invalid %d", 1)
+
 func foo() error {
-	err := errors.New("error")
-	return err
+	return errors.New("foo")
 }
 `,
-		`package foo
+			`package foo
 
 import (
-	"bar"
+	stderrors "errors"
 	"github.com/pkg/errors"
 )
 
+var ErrNotFound = stderrors.New("not found")
+var ErrExists = stderrors.New("exists, 100%")
+var ErrInvalid = fmt.Errorf("invalid %d", 1)
+
 func foo() error {
-	err := errors.New("error")
-	return errors.WithStack(err)
+	return errors.New("foo")
 }
 `,
-	},
-	{
-		"WithStack#3",
-		"do not replace package github.com/pkg/errors",
-		`package foo
+		},
+		{
+			ModePkgErrors,
+			`package foo
+
+var ErrNotFound = fmt.Errorf("not found")
+`,
+			`package foo
 
 import (
-	"github.com/pkg/errors"
+	"errors"
 )
 
-func foo() error {
-	err := errors.New("error")
-	return err
-}
+var ErrNotFound = errors.New("not found")
 `,
-		`package foo
+		},
+		{
+			ModeStdErrors,
+			`package foo
 
 import (
 	"github.com/pkg/errors"
 )
 
-func foo() error {
-	err := errors.New("error")
-	return errors.WithStack(err)
-}
-`,
-	},
-	{
-		"WithStack#4",
-		"a function foo which returns integer and error",
-		`package foo
-
-func foo() (int, error) {
-	var err error
-	return 1, err
-}
+var ErrNotFound = fmt.Errorf("not found")
 `,
-		`package foo
+			`package foo
 
 import (
+	stderrors "errors"
 	"github.com/pkg/errors"
 )
 
-func foo() (int, error) {
-	var err error
-	return 1, errors.WithStack(err)
-}
+var ErrNotFound = stderrors.New("not found")
 `,
-	},
-	{
-		"WithStack#5",
-		"when multiple import keywords exist",
-		`package main
+		},
+	}
+	for _, c := range cases {
+		p := NewProcessor(WithMode(c.mode), WithStdSentinels(true))
+		f2, err := p.Process(context.Background(), &File{Name: "sentinel.go", Content: c.input})
+		require.Nil(t, err)
+		require.Equal(t, c.output, f2.Content)
+	}
+
+	// Without WithStdSentinels, errors.New sentinels keep the standard library when the import is replaced.
+	input := `package foo
 
-import "bar"
-import "foo"
 import (
-	"baz"
+	"errors"
 )
 
-func main() {
-
-}
+var ErrY = errors.New("y")
 
 func foo() error {
-	var err error
 	return err
 }
-`,
-		`package main
+`
+	output := `package foo
 
 import (
-	"bar"
+	stderrors "errors"
 	"github.com/pkg/errors"
 )
-import "foo"
-import (
-	"baz"
-)
 
-func main() {
-
-}
+var ErrY = stderrors.New("y")
 
 func foo() error {
-	var err error
 	return errors.WithStack(err)
 }
-`,
-	},
-	{
-		"Cause#1",
-		"use Cause to compare errors",
-		`package foo
+`
+	f2, err := NewProcessor().Process(context.Background(), &File{Name: "sentinel.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, output, f2.Content)
+}
 
-func foo() error {
-	var err error
-	if err != nil {
-		return err
-	}
-	if err == nil {
+// panicRule wraps the errors passed to panic with errors.WithStack.
+type panicRule struct {
+	changed bool
+}
+
+func (r *panicRule) Name() string {
+	return "panic"
+}
+
+func (r *panicRule) Description() string {
+	return "wrap errors passed to panic with errors.WithStack"
+}
+
+func (r *panicRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	call, ok := n.(*dst.CallExpr)
+	if !ok || !isName(call.Fun, "panic") || len(call.Args) != 1 {
 		return nil
 	}
-	if err != ErrNotFound {
-		return err
-	}
-	if err == ErrNotFound {
+	if !p.IsErr(call.Args[0]) {
+		p.Note(call, "panic of a value that is not an error")
 		return nil
 	}
-	if err != nil && err != ErrNotFound {
-		return nil
+	call.Args[0] = &dst.CallExpr{
+		Fun:  &dst.SelectorExpr{X: dst.NewIdent("errors"), Sel: dst.NewIdent("WithStack")},
+		Args: []dst.Expr{call.Args[0]},
 	}
-	if err != nil && err == ErrNotFound {
-		return nil
+	r.changed = true
+	return nil
+}
+
+func (r *panicRule) EndProcess(ctx context.Context, p *Pass, f *dst.File) (bool, error) {
+	if r.changed {
+		usePkgErrors(f)
 	}
-	return err
+	return r.changed, nil
 }
-`,
-		`package foo
+
+func TestErrFixRules(t *testing.T) {
+	input := `package foo
+
+func foo(err error) error {
+	if err != nil {
+		panic(err)
+	}
+	panic("unreachable")
+}
+`
+	output := `package foo
 
 import (
 	"github.com/pkg/errors"
 )
 
-func foo() error {
-	var err error
+func foo(err error) error {
 	if err != nil {
-		return errors.WithStack(err)
+		panic(errors.WithStack(err))
 	}
-	if err == nil {
-		return nil
+	panic("unreachable")
+}
+`
+	p := NewProcessor(WithRules(func() Rule { return &panicRule{} }))
+	f2, err := p.Process(context.Background(), &File{Name: "panic.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, output, f2.Content)
+	require.Len(t, f2.Notes, 1)
+	require.Equal(t, "panic.go:7:2: panic of a value that is not an error (panic)", f2.Notes[0].String())
+
+	require.Equal(t, []string{"as", "cause", "cause-as", "cause-is", "errorf-w", "is", "withstack", "wrapf"}, RegisteredRules())
+	newRule, err := LookupRule("withstack")
+	require.Nil(t, err)
+	require.Equal(t, "withstack", newRule().Name())
+	_, err = LookupRule("panic")
+	require.NotNil(t, err)
+}
+
+func TestErrFixIgnore(t *testing.T) {
+	input := `package foo
+
+// passthrough returns the errors of r as they are.
+//
+//errfix:ignore withstack
+func passthrough(r io.Reader) error {
+	if err := read(r); err != nil {
+		return err
 	}
-	if errors.Cause(err) != ErrNotFound {
-		return errors.WithStack(err)
+	if err := read(r); err == errBusy {
+		return fmt.Errorf("busy: %v", err)
 	}
-	if errors.Cause(err) == ErrNotFound {
-		return nil
+	return nil
+}
+
+func foo() error {
+	err := bar()
+	if err != nil {
+		return err //errfix:ignore
 	}
-	if err != nil && errors.Cause(err) != ErrNotFound {
+	//errfix:ignore cause,wrapf callers compare it
+	if err == errBusy {
+		return fmt.Errorf("busy: %v", err)
+	}
+	//errfix:ignore cause
+	if bar() != nil {
 		return nil
 	}
-	if err != nil && errors.Cause(err) == ErrNotFound {
+	return err
+}
+`
+	output := `package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+// passthrough returns the errors of r as they are.
+//
+//errfix:ignore withstack
+func passthrough(r io.Reader) error {
+	if err := read(r); err != nil {
+		return err
+	}
+	if err := read(r); errors.Cause(err) == errBusy {
+		return errors.Wrapf(err, "busy")
+	}
+	return nil
+}
+
+func foo() error {
+	err := bar()
+	if err != nil {
+		return err //errfix:ignore
+	}
+	//errfix:ignore cause,wrapf callers compare it
+	if err == errBusy {
+		return fmt.Errorf("busy: %v", err)
+	}
+	//errfix:ignore cause
+	if bar() != nil {
 		return nil
 	}
 	return errors.WithStack(err)
+}
+`
+	p := NewProcessor()
+	f2, err := p.Process(context.Background(), &File{Name: "ignore.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, output, f2.Content)
+	require.Len(t, f2.Notes, 1)
+	require.Equal(t, "ignore.go:26:2: //errfix:ignore cause suppresses nothing (ignore)", f2.Notes[0].String())
+
+	// The calls of errors.New whose rewrite is suppressed keep the errors package of the standard library,
+	// when the import is switched to github.com/pkg/errors.
+	input = `package foo
+
+import "errors"
+
+func foo() error {
+	if err := bar(); err != nil {
+		return err
+	}
+	return errors.New("foo") //errfix:ignore wrapf
+}
+`
+	output = `package foo
+
+import (
+	"github.com/pkg/errors"
+
+	stderrors "errors"
+)
+
+func foo() error {
+	if err := bar(); err != nil {
+		return errors.WithStack(err)
+	}
+	return stderrors.New("foo") //errfix:ignore wrapf
+}
+`
+	f2, err = p.Process(context.Background(), &File{Name: "ignore.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, output, f2.Content)
+
+	input = `//errfix:ignore -- generated code
+package foo
+
+func foo() error {
+	return err
+}
+`
+	f2, err = p.Process(context.Background(), &File{Name: "ignore.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, input, f2.Content)
+	require.Len(t, f2.Notes, 0)
+}
+
+func TestErrFixPatternRules(t *testing.T) {
+	input := `package foo
+
+func foo(r io.Reader, name string) error {
+	_, err := r.Read(nil)
+	if err == io.EOF || err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		log.Println(err)
+		log.Println(name)
+	}
+	return errors.Wrap(err, fmt.Sprintf("reading %s", name))
+}
+`
+	output := `package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+func foo(r io.Reader, name string) error {
+	_, err := r.Read(nil)
+	if errors.Is(err, io.EOF) || err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("%+v", err)
+		log.Println(name)
+	}
+	return errors.Wrapf(err, "reading %s", name)
+}
+`
+	var newRules []NewRuleFunc
+	for _, name := range []string{"sentinels.errfix", "pkg.yaml"} {
+		rules, err := LoadPatternRules(filepath.Join("testdata", "rules", name))
+		require.Nil(t, err)
+		compiled, err := CompilePatternRules(rules)
+		require.Nil(t, err)
+		newRules = append(newRules, compiled...)
+	}
+	// No built-in rule runs in an unknown mode.
+	p := NewProcessor(WithMode(Mode(-1)), WithRules(newRules...))
+	f2, err := p.Process(context.Background(), &File{Name: "pattern.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, output, f2.Content)
+
+	invalid := []PatternRule{
+		{Name: "missing", Pattern: "f($x)", Replace: "g($y)"},
+		{Name: "kind", Pattern: "f($x)", Replace: "g($x)", Where: map[string]string{"$x": "int"}},
+		{Name: "syntax", Pattern: "f($x", Replace: "g($x)"},
+		{Pattern: "f($x)", Replace: "g($x)"},
+	}
+	for _, r := range invalid {
+		_, err := r.Compile()
+		require.NotNil(t, err, r.Name)
+	}
+	_, err = parsePatternLines([]byte("f($x) -> g($x)\n"))
+	require.NotNil(t, err)
+}
+
+func TestLoadConfig(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "errfix.yaml")
+	err := os.WriteFile(name, []byte("mode: std\nerr-name: ^(err|.*Err)$\n"), 0644)
+	require.Nil(t, err)
+
+	c, err := LoadConfig(name)
+	require.Nil(t, err)
+	require.Equal(t, &Config{Mode: "std", ErrName: "^(err|.*Err)$"}, c)
+	opts, err := c.ProcessorOptions()
+	require.Nil(t, err)
+	require.Len(t, opts, 2)
+
+	// Unknown keys are reported with the file.
+	err = os.WriteFile(name, []byte("mode: std\nerrname: err\n"), 0644)
+	require.Nil(t, err)
+	_, err = LoadConfig(name)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), name)
+	require.Contains(t, err.Error(), "field errname not found")
+	require.Nil(t, os.WriteFile(name, nil, 0644))
+	c, err = LoadConfig(name)
+	require.Nil(t, err)
+	require.Equal(t, &Config{}, c)
+
+	_, err = (&Config{ErrName: "("}).ProcessorOptions()
+	require.NotNil(t, err)
+	_, err = (&Config{Mode: "xerrors"}).ProcessorOptions()
+	require.NotNil(t, err)
+	_, err = (&Config{Exclude: []string{"["}}).ProcessorOptions()
+	require.NotNil(t, err)
+
+	// The exclude patterns of a Config built in code are relative to the working directory.
+	c = &Config{Exclude: []string{"legacy", "*_gen.go"}}
+	require.True(t, c.Excluded("legacy/foo.go"))
+	require.True(t, c.Excluded("foo_gen.go"))
+	require.False(t, c.Excluded("foo.go"))
+	require.False(t, c.Excluded(filepath.Join(t.TempDir(), "legacy", "foo.go")))
+	p, err := c.Processor()
+	require.Nil(t, err)
+	input := "package foo\n\nfunc foo() error {\n\treturn err\n}\n"
+	f2, err := p.Process(context.Background(), &File{Name: "legacy/foo.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, input, f2.Content)
+	f2, err = p.Process(context.Background(), &File{Name: "foo.go", Content: input})
+	require.Nil(t, err)
+	require.Contains(t, f2.Content, "errors.WithStack(err)")
+}
+
+func TestLoadDirConfig(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		ConfigFileName:                "root: true\nmode: std\nmessage-style: lower\nexclude:\n  - legacy\n  - \"*_gen.go\"\n",
+		"svc/" + ConfigFileName:       "mode: pkg\nexclude:\n  - old/*.go\n",
+		"foo.go":                      "",
+		"foo_gen.go":                  "",
+		"legacy/foo.go":               "",
+		"svc/foo.go":                  "",
+		"svc/old/foo.go":              "",
+		"svc/old/internal/foo.go":     "",
+		"svc/legacy_test/foo_test.go": "",
+	}
+	for name, content := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		require.Nil(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.Nil(t, os.WriteFile(name, []byte(content), 0644))
+	}
+
+	c, err := LoadDirConfig(filepath.Join(root, "svc", "old"))
+	require.Nil(t, err)
+	require.Equal(t, "pkg", c.Mode)
+	require.Equal(t, "lower", c.MessageStyle)
+	excluded := map[string]bool{
+		"foo.go":                      false,
+		"foo_gen.go":                  true,
+		"legacy/foo.go":               true,
+		"svc/foo.go":                  false,
+		"svc/old/foo.go":              true,
+		"svc/old/internal/foo.go":     false,
+		"svc/legacy_test/foo_test.go": false,
+	}
+	for name, ok := range excluded {
+		require.Equal(t, ok, c.Excluded(filepath.Join(root, filepath.FromSlash(name))), name)
+	}
+
+	input := `package foo
+
+func foo() error {
+	return fmt.Errorf("Reading: %v", err)
+}
+`
+	outputs := map[string]string{
+		"foo.go": `package foo
+
+func foo() error {
+	return fmt.Errorf("reading: %w", err)
+}
+`,
+		"svc/foo.go": `package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+func foo() error {
+	return errors.Wrapf(err, "reading")
+}
+`,
+		"legacy/foo.go": input,
+	}
+	p := NewConfigProcessor(nil)
+	for name, output := range outputs {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		f2, err := p.Process(context.Background(), &File{Name: name, Content: input})
+		require.Nil(t, err)
+		require.Equal(t, output, f2.Content, name)
+	}
+
+	p = NewConfigProcessor(func(c *Config) { c.Mode = "xerrors" })
+	_, err = p.Process(context.Background(), &File{Name: filepath.Join(root, "foo.go"), Content: input})
+	require.NotNil(t, err)
+}
+
+func TestMessageStyle(t *testing.T) {
+	ps := &Pass{messageStyle: MessageStyleLower}
+	cases := map[string]string{
+		"Reading %s.":   "reading %s",
+		"EOF reached":   "EOF reached",
+		"I/O failure":   "I/O failure",
+		"A file":        "a file",
+		"OAuth failed!": "OAuth failed",
+		"%s: Failed":    "%s: Failed",
+	}
+	for in, out := range cases {
+		require.Equal(t, out, ps.styleMessage(in), in)
+	}
+	require.Equal(t, "Reading.", (&Pass{}).styleMessage("Reading."))
+	style, err := ParseMessageStyle("lower")
+	require.Nil(t, err)
+	require.Equal(t, MessageStyleLower, style)
+	_, err = ParseMessageStyle("upper")
+	require.NotNil(t, err)
+}
+
+func TestParseFormat(t *testing.T) {
+	verbs, reordered, ok := parseFormat("%d%% of %-8.*[4]s: %+v", 5)
+	require.True(t, ok)
+	require.True(t, reordered)
+	require.Equal(t, []formatVerb{
+		{start: 0, end: 2, verb: 'd', arg: 0},
+		{start: 8, end: 17, flags: "-", sized: true, verb: 's', arg: 3},
+		{start: 19, end: 22, flags: "+", verb: 'v', arg: 4},
+	}, verbs)
+
+	invalid := map[string]int{
+		"%d %v":   1,
+		"%d":      2,
+		"%[3]v":   2,
+		"%*d":     1,
+		"done %":  0,
+		"%[1v":    1,
+		"%d %[x]": 1,
+	}
+	for format, nargs := range invalid {
+		_, _, ok := parseFormat(format, nargs)
+		require.False(t, ok, format)
+	}
+}
+
+func TestErrFixErrorfNotes(t *testing.T) {
+	input := `package foo
+
+func foo() error {
+	if err != nil {
+		return fmt.Errorf("open %v failed", err)
+	}
+	return fmt.Errorf("open: %v, close: %v", err, err)
+}
+`
+	f2, err := NewProcessor().Process(context.Background(), &File{Name: "foo.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, input, f2.Content)
+	require.Len(t, f2.Notes, 2)
+	require.Equal(t, "foo.go:5:10: fmt.Errorf left unchanged: the error is not at the end of the message, where errors.Wrapf puts it (wrapf)", f2.Notes[0].String())
+	require.Equal(t, "foo.go:7:9: fmt.Errorf left unchanged: several errors are formatted, while errors.Wrapf wraps one (wrapf)", f2.Notes[1].String())
+
+	f2, err = NewProcessor(WithMode(ModeStdErrors)).Process(context.Background(), &File{Name: "foo.go", Content: input})
+	require.Nil(t, err)
+	require.Len(t, f2.Notes, 1)
+	require.Equal(t, "foo.go:7:9: fmt.Errorf left unchanged: several errors are formatted, and %w can be used more than once only since Go 1.20 (errorf-w)", f2.Notes[0].String())
+}
+
+func TestParseMode(t *testing.T) {
+	for _, m := range []Mode{ModePkgErrors, ModeStdErrors} {
+		m2, err := ParseMode(m.String())
+		require.Nil(t, err)
+		require.Equal(t, m, m2)
+	}
+	_, err := ParseMode("xerrors")
+	require.NotNil(t, err)
+}
+
+func TestSplitList(t *testing.T) {
+	require.Equal(t, []string{"withstack", "cause"}, SplitList("withstack, cause"))
+	require.Equal(t, []string{"a.rules"}, SplitList(",a.rules,, "))
+	require.Empty(t, SplitList(""))
+}
+
+type normalCase struct {
+	Name   string
+	Desc   string
+	Input  string
+	Output string
+}
+
+var testNormalCases = []normalCase{
+	{
+		"Unchanged #1",
+		"a simple empty function",
+		`package foo
+
+func foo() {
+
+}
+`,
+		`package foo
+
+func foo() {
+
 }
 `,
 	},
 	{
-		"Cause#2",
-		"use Cause to compare type assert",
+		"Comment#1",
+		"the function foo has a comment inside",
 		`package foo
 
 func foo() error {
 	var err error
-	if e, ok := err.(CustomError); ok {
-		return e
-	}
-	switch e := err.(type) {
-	case CustomError:
-		return e
+	// Comment A
+	if err != nil {
+		// Comment B
+		return err
 	}
+	// Comment C
 	return err
 }
 `,
@@ -308,20 +968,50 @@ import (
 
 func foo() error {
 	var err error
-	if e, ok := errors.Cause(err).(CustomError); ok {
-		return e
-	}
-	switch e := errors.Cause(err).(type) {
-	case CustomError:
-		return e
+	// Comment A
+	if err != nil {
+		// Comment B
+		return errors.WithStack(err)
 	}
+	// Comment C
 	return errors.WithStack(err)
 }
 `,
 	},
+
 	{
-		"errors.New#1",
-		"replace the errors.New with github.com/pkg/errors.New",
+		"WithStack#1",
+		"a function foo which returns error",
+		`package main
+
+func main() {
+
+}
+
+func foo() error {
+	var err error
+	return err
+}
+`,
+		`package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+func main() {
+
+}
+
+func foo() error {
+	var err error
+	return errors.WithStack(err)
+}
+`,
+	},
+	{
+		"WithStack#2",
+		"replace the errors package with github.com/pkg/errors",
 		`package foo
 
 import (
@@ -329,7 +1019,10 @@ import (
 	"errors"
 )
 
-var ErrNotFound = errors.New("not found")
+func foo() error {
+	err := errors.New("error")
+	return err
+}
 `,
 		`package foo
 
@@ -338,41 +1031,1906 @@ import (
 	"github.com/pkg/errors"
 )
 
-var ErrNotFound = errors.New("not found")
+func foo() error {
+	err := errors.New("error")
+	return errors.WithStack(err)
+}
 `,
 	},
 	{
-		"fmt.Errorf#1",
-		"replace the fmt.Errorf with github.com/pkg/errors.Errorf",
+		"WithStack#3",
+		"do not replace package github.com/pkg/errors",
 		`package foo
 
 import (
-	"bar"
-	"errors"
+	"github.com/pkg/errors"
 )
 
-var ErrNotFound = fmt.Errorf("not found")
-var ErrNotFound2 = fmt.Errorf("not found %d", 1)
-var ErrNotFound3 = fmt.Errorf("not found %d %d", 1, 2)
-var ErrNotFound4 = fmt.Errorf("not found: %v", err)
-var ErrNotFound5 = fmt.Errorf("not found, %v", err)
-var ErrNotFound6 = fmt.Errorf("not found %d: %v", 1, err)
-var ErrNotFound7 = fmt.Errorf("not found %d %d: %v", 1, 2, err)
+func foo() error {
+	err := errors.New("error")
+	return err
+}
+`,
+		`package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+func foo() error {
+	err := errors.New("error")
+	return errors.WithStack(err)
+}
+`,
+	},
+	{
+		"WithStack#4",
+		"a function foo which returns integer and error",
+		`package foo
+
+func foo() (int, error) {
+	var err error
+	return 1, err
+}
 `,
 		`package foo
 
 import (
-	"bar"
 	"github.com/pkg/errors"
 )
 
-var ErrNotFound = errors.Errorf("not found")
-var ErrNotFound2 = errors.Errorf("not found %d", 1)
-var ErrNotFound3 = errors.Errorf("not found %d %d", 1, 2)
-var ErrNotFound4 = errors.Wrapf(err, "not found")
-var ErrNotFound5 = errors.Wrapf(err, "not found")
-var ErrNotFound6 = errors.Wrapf(err, "not found %d", 1)
-var ErrNotFound7 = errors.Wrapf(err, "not found %d %d", 1, 2)
+func foo() (int, error) {
+	var err error
+	return 1, errors.WithStack(err)
+}
+`,
+	},
+	{
+		"WithStack#5",
+		"when multiple import keywords exist",
+		`package main
+
+import "bar"
+import "foo"
+import (
+	"baz"
+)
+
+func main() {
+
+}
+
+func foo() error {
+	var err error
+	return err
+}
+`,
+		`package main
+
+import (
+	"bar"
+	"github.com/pkg/errors"
+)
+import "foo"
+import (
+	"baz"
+)
+
+func main() {
+
+}
+
+func foo() error {
+	var err error
+	return errors.WithStack(err)
+}
+`,
+	},
+	{
+		"Cause#1",
+		"use Cause to compare errors",
+		`package foo
+
+func foo() error {
+	var err error
+	if err != nil {
+		return err
+	}
+	if err == nil {
+		return nil
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil && err != ErrNotFound {
+		return nil
+	}
+	if err != nil && err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+`,
+		`package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+func foo() error {
+	var err error
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err == nil {
+		return nil
+	}
+	if errors.Cause(err) != ErrNotFound {
+		return errors.WithStack(err)
+	}
+	if errors.Cause(err) == ErrNotFound {
+		return nil
+	}
+	if err != nil && errors.Cause(err) != ErrNotFound {
+		return nil
+	}
+	if err != nil && errors.Cause(err) == ErrNotFound {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+`,
+	},
+	{
+		"Cause#2",
+		"use Cause to compare type assert",
+		`package foo
+
+func foo() error {
+	var err error
+	if e, ok := err.(CustomError); ok {
+		return e
+	}
+	switch e := err.(type) {
+	case CustomError:
+		return e
+	}
+	return err
+}
+`,
+		`package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+func foo() error {
+	var err error
+	if e, ok := errors.Cause(err).(CustomError); ok {
+		return e
+	}
+	switch e := errors.Cause(err).(type) {
+	case CustomError:
+		return e
+	}
+	return errors.WithStack(err)
+}
+`,
+	},
+	{
+		"Cause#3",
+		"use Cause in switches on errors",
+		`package foo
+
+func foo() error {
+	var err error
+	switch err {
+	case ErrNotFound:
+		return nil
+	case nil:
+		return nil
+	}
+	switch err {
+	case nil:
+		return nil
+	}
+	return nil
+}
+`,
+		`package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+func foo() error {
+	var err error
+	switch errors.Cause(err) {
+	case ErrNotFound:
+		return nil
+	case nil:
+		return nil
+	}
+	switch err {
+	case nil:
+		return nil
+	}
+	return nil
+}
+`,
+	},
+	{
+		"errors.New#1",
+		"package-level sentinels do not replace the errors package",
+		`package foo
+
+import (
+	"bar"
+	"errors"
+)
+
+var ErrNotFound = errors.New("not found")
+`,
+		`package foo
+
+import (
+	"bar"
+	"errors"
+)
+
+var ErrNotFound = errors.New("not found")
+`,
+	},
+	{
+		"errors.New#2",
+		"replace the errors.New with github.com/pkg/errors.New",
+		`package foo
+
+import (
+	"bar"
+	"errors"
+)
+
+func foo() error {
+	return errors.New("not found")
+}
+`,
+		`package foo
+
+import (
+	"bar"
+	"github.com/pkg/errors"
+)
+
+func foo() error {
+	return errors.New("not found")
+}
+`,
+	},
+	{
+		"fmt.Errorf#1",
+		"replace the fmt.Errorf with github.com/pkg/errors.Errorf",
+		`package foo
+
+import (
+	"bar"
+	"errors"
+)
+
+func foo(err error) {
+	var ErrNotFound = fmt.Errorf("not found")
+	var ErrNotFound2 = fmt.Errorf("not found %d", 1)
+	var ErrNotFound3 = fmt.Errorf("not found %d %d", 1, 2)
+	var ErrNotFound4 = fmt.Errorf("not found: %v", err)
+	var ErrNotFound5 = fmt.Errorf("not found, %v", err)
+	var ErrNotFound6 = fmt.Errorf("not found %d: %v", 1, err)
+	var ErrNotFound7 = fmt.Errorf("not found %d %d: %v", 1, 2, err)
+}
+`,
+		`package foo
+
+import (
+	"bar"
+	"github.com/pkg/errors"
+)
+
+func foo(err error) {
+	var ErrNotFound = errors.Errorf("not found")
+	var ErrNotFound2 = errors.Errorf("not found %d", 1)
+	var ErrNotFound3 = errors.Errorf("not found %d %d", 1, 2)
+	var ErrNotFound4 = errors.Wrapf(err, "not found")
+	var ErrNotFound5 = errors.Wrapf(err, "not found")
+	var ErrNotFound6 = errors.Wrapf(err, "not found %d", 1)
+	var ErrNotFound7 = errors.Wrapf(err, "not found %d %d", 1, 2)
+}
+`,
+	},
+	{
+		"fmt.Errorf#2",
+		"package-level sentinels are not converted to errors.Errorf",
+		`package foo
+
+var ErrNotFound = fmt.Errorf("not found")
+var ErrNotFound2 = fmt.Errorf("not found %d", 1)
+var ErrHandler = func(err error) error {
+	return fmt.Errorf("handler: %v", err)
+}
+`,
+		`package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+var ErrNotFound = fmt.Errorf("not found")
+var ErrNotFound2 = fmt.Errorf("not found %d", 1)
+var ErrHandler = func(err error) error {
+	return errors.Wrapf(err, "handler")
+}
+`,
+	},
+	{
+		"fmt.Errorf#3",
+		"errors formatted at the end of the message with %s, %+v or %w are wrapped",
+		`package foo
+
+func foo(name string, err error) {
+	var err1 = fmt.Errorf("open %s: %s", name, err)
+	var err2 = fmt.Errorf("open %q, %+v", name, err)
+	var err3 = fmt.Errorf("open %*d %w", 4, 1, err)
+	var err4 = fmt.Errorf(` + "`open \"%s\": %v`" + `, name, err)
+	var err5 = fmt.Errorf("%v", err)
+	var err6 = fmt.Errorf("100%% %d", 1)
+}
+`,
+		`package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+func foo(name string, err error) {
+	var err1 = errors.Wrapf(err, "open %s", name)
+	var err2 = errors.Wrapf(err, "open %q", name)
+	var err3 = errors.Wrapf(err, "open %*d", 4, 1)
+	var err4 = errors.Wrapf(err, ` + "`open \"%s\"`" + `, name)
+	var err5 = errors.WithStack(err)
+	var err6 = errors.Errorf("100%% %d", 1)
+}
+`,
+	},
+	{
+		"fmt.Errorf#4",
+		"errors that errors.Wrapf cannot format the same are left unchanged",
+		`package foo
+
+func foo(name string, err error) {
+	var err1 = fmt.Errorf("open %v failed for %s", err, name)
+	var err2 = fmt.Errorf("open: %q", err)
+	var err3 = fmt.Errorf("open %[2]s: %[1]v", err, name)
+	var err4 = fmt.Errorf("open: %v, close: %v", err, err)
+	var err5 = fmt.Errorf("code=%v", err)
+	var err6 = fmt.Errorf("open %s: %w", name)
+}
+`,
+		`package foo
+
+func foo(name string, err error) {
+	var err1 = fmt.Errorf("open %v failed for %s", err, name)
+	var err2 = fmt.Errorf("open: %q", err)
+	var err3 = fmt.Errorf("open %[2]s: %[1]v", err, name)
+	var err4 = fmt.Errorf("open: %v, close: %v", err, err)
+	var err5 = fmt.Errorf("code=%v", err)
+	var err6 = fmt.Errorf("open %s: %w", name)
+}
+`,
+	},
+	{
+		"Alias#1",
+		"the errors package keeps its alias when it is replaced",
+		`package foo
+
+import (
+	stderrors "errors"
+)
+
+func foo() error {
+	err := stderrors.New("foo")
+	if err == ErrX {
+		return err
+	}
+	return nil
+}
+`,
+		`package foo
+
+import (
+	stderrors "github.com/pkg/errors"
+)
+
+func foo() error {
+	err := stderrors.New("foo")
+	if stderrors.Cause(err) == ErrX {
+		return stderrors.WithStack(err)
+	}
+	return nil
+}
+`,
+	},
+}
+
+var testStdCases = []normalCase{
+	{
+		"Std#1",
+		"returns are left alone and no import is added",
+		`package foo
+
+func foo() error {
+	var err error
+	if err != nil {
+		return err
+	}
+	return err
+}
+`,
+		`package foo
+
+func foo() error {
+	var err error
+	if err != nil {
+		return err
+	}
+	return err
+}
+`,
+	},
+	{
+		"Std#2",
+		"replace %v with %w in fmt.Errorf",
+		`package foo
+
+import (
+	"fmt"
+)
+
+func foo() error {
+	var err error
+	if err != nil {
+		return fmt.Errorf("not found %d: %v", 1, err)
+	}
+	return fmt.Errorf("not found %d", 1)
+}
+`,
+		`package foo
+
+import (
+	"fmt"
+)
+
+func foo() error {
+	var err error
+	if err != nil {
+		return fmt.Errorf("not found %d: %w", 1, err)
+	}
+	return fmt.Errorf("not found %d", 1)
+}
+`,
+	},
+	{
+		"Std#7",
+		"errors formatted with %s or %+v, anywhere in the message, are wrapped with %w",
+		`package foo
+
+import (
+	"fmt"
+)
+
+func foo(name string, err error) error {
+	if err != nil {
+		return fmt.Errorf("open %+v failed for %s", err, name)
+	}
+	if err != nil {
+		return fmt.Errorf(` + "`open \"%s\": %s`" + `, name, err)
+	}
+	if err != nil {
+		return fmt.Errorf("open %[2]s: %[1]v", err, name)
+	}
+	if err != nil {
+		return fmt.Errorf("open: %q", err)
+	}
+	return fmt.Errorf("open: %v, close: %v", err, err)
+}
+`,
+		`package foo
+
+import (
+	"fmt"
+)
+
+func foo(name string, err error) error {
+	if err != nil {
+		return fmt.Errorf("open %+w failed for %s", err, name)
+	}
+	if err != nil {
+		return fmt.Errorf(` + "`open \"%s\": %w`" + `, name, err)
+	}
+	if err != nil {
+		return fmt.Errorf("open %[2]s: %[1]w", err, name)
+	}
+	if err != nil {
+		return fmt.Errorf("open: %q", err)
+	}
+	return fmt.Errorf("open: %v, close: %v", err, err)
+}
+`,
+	},
+	{
+		"Std#3",
+		"use errors.Is to compare errors",
+		`package foo
+
+func foo() error {
+	var err error
+	if err == nil {
+		return nil
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil && err != ErrNotFound {
+		return nil
+	}
+	return err
+}
+`,
+		`package foo
+
+import (
+	"errors"
+)
+
+func foo() error {
+	var err error
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+`,
+	},
+	{
+		"Std#4",
+		"use errors.As for type assertions",
+		`package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+func foo() error {
+	var err error
+	// Comment A
+	if e, ok := err.(*CustomError); ok {
+		return e
+	}
+	e2, ok := err.(*CustomError)
+	if ok {
+		return e2
+	}
+	if _, ok := err.(CustomError); ok {
+		return nil
+	}
+	switch e := err.(type) {
+	case *CustomError:
+		return e
+	}
+	return err
+}
+`,
+		`package foo
+
+import (
+	"github.com/pkg/errors"
+)
+
+func foo() error {
+	var err error
+	// Comment A
+	if e := (*CustomError)(nil); errors.As(err, &e) {
+		return e
+	}
+	var e2 *CustomError
+	ok := errors.As(err, &e2)
+	if ok {
+		return e2
+	}
+	if ok := errors.As(err, new(CustomError)); ok {
+		return nil
+	}
+	if e := (*CustomError)(nil); errors.As(err, &e) {
+		return e
+	}
+	return err
+}
+`,
+	},
+	{
+		"Std#5",
+		"use errors.Is in switches on errors",
+		`package foo
+
+func foo() error {
+	var err error
+	switch err {
+	case ErrNotFound, ErrGone:
+		return nil
+	case nil:
+		fallthrough
+	case io.EOF:
+		return err
+	default:
+		return err
+	}
+}
+`,
+		`package foo
+
+import (
+	"errors"
+)
+
+func foo() error {
+	var err error
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrGone):
+		return nil
+	case err == nil:
+		fallthrough
+	case errors.Is(err, io.EOF):
+		return err
+	default:
+		return err
+	}
+}
+`,
+	},
+	{
+		"Std#6",
+		"use errors.As in type switches on errors",
+		`package foo
+
+func foo() error {
+	var err error
+	// Comment A
+	switch e := err.(type) {
+	case *CustomError:
+		return e
+	case *os.PathError, *os.LinkError:
+		return e
+	case nil:
+		return nil
+	case CodeError:
+		return e
+	default:
+		log.Print(e)
+	}
+	switch err.(type) {
+	case *CustomError:
+		return nil
+	}
+	switch e := err.(type) {
+	case *CustomError:
+		if e.Code == 0 {
+			break
+		}
+		return e
+	}
+	return err
+}
+`,
+		`package foo
+
+import (
+	"errors"
+)
+
+func foo() error {
+	var err error
+	// Comment A
+	if e := (*CustomError)(nil); errors.As(err, &e) {
+		return e
+	} else if e := err; errors.As(err, new(*os.PathError)) || errors.As(err, new(*os.LinkError)) {
+		return e
+	} else if err == nil {
+		return nil
+	} else if e := *new(CodeError); errors.As(err, &e) {
+		return e
+	} else {
+		e := err
+		log.Print(e)
+	}
+	if errors.As(err, new(*CustomError)) {
+		return nil
+	}
+	switch e := err.(type) {
+	case *CustomError:
+		if e.Code == 0 {
+			break
+		}
+		return e
+	}
+	return err
+}
+`,
+	},
+	{
+		"Std#9",
+		"keep the comments of the clauses of type switches",
+		`package foo
+
+func foo() error {
+	var err error
+	switch e := err.(type) {
+	// Comment A
+	case *CustomError: // Comment B
+		return e
+	// Comment C
+	case nil:
+		// Comment D
+		return nil
+	// Comment E
+	default: // Comment F
+		log.Print(e)
+	}
+	return err
+}
+`,
+		`package foo
+
+import (
+	"errors"
+)
+
+func foo() error {
+	var err error
+	// Comment A
+	if e := (*CustomError)(nil); errors.As(err, &e) { // Comment B
+		return e
+	} else if err == nil { // Comment C
+		// Comment D
+		return nil
+	} else { // Comment E
+		// Comment F
+		e := err
+		log.Print(e)
+	}
+	return err
+}
+`,
+	},
+	{
+		"Std#8",
+		"targets of errors.As stay scoped to their if statement",
+		`package foo
+
+import (
+	"errors"
+)
+
+func foo(err error) int {
+	if e, ok := err.(*MyErr); ok {
+		return e.Code
+	}
+	if e, ok := err.(*MyErr); ok && e.Code > 0 {
+		return e.Code
+	}
+	if e, ok := err.(*MyErr); e != nil {
+		log(ok)
+	}
+	var e *MyErr
+	e, ok := err.(*MyErr)
+	if ok {
+		return e.Code
+	}
+	return 0
+}
+`,
+		`package foo
+
+import (
+	"errors"
+)
+
+func foo(err error) int {
+	if e := (*MyErr)(nil); errors.As(err, &e) {
+		return e.Code
+	}
+	if e := (*MyErr)(nil); errors.As(err, &e) && e.Code > 0 {
+		return e.Code
+	}
+	{
+		var e *MyErr
+		if ok := errors.As(err, &e); e != nil {
+			log(ok)
+		}
+	}
+	var e *MyErr
+	ok := errors.As(err, &e)
+	if ok {
+		return e.Code
+	}
+	return 0
+}
+`,
+	},
+	{
+		"Std#10",
+		"errors.Is and errors.As use the alias of the errors package",
+		`package foo
+
+import (
+	stderrors "errors"
+)
+
+func foo(err error) int {
+	if err == ErrX {
+		return 1
+	}
+	if e, ok := err.(*MyErr); ok {
+		return e.Code
+	}
+	return 0
+}
+`,
+		`package foo
+
+import (
+	stderrors "errors"
+)
+
+func foo(err error) int {
+	if stderrors.Is(err, ErrX) {
+		return 1
+	}
+	if e := (*MyErr)(nil); stderrors.As(err, &e) {
+		return e.Code
+	}
+	return 0
+}
+`,
+	},
+	{
+		"Std#11",
+		"the errors package is imported as stderrors when the name errors is taken",
+		`package foo
+
+import (
+	errors "example.com/errors"
+)
+
+func foo(err error) error {
+	if err == ErrX {
+		return errors.New("x")
+	}
+	return nil
+}
+`,
+		`package foo
+
+import (
+	stderrors "errors"
+	errors "example.com/errors"
+)
+
+func foo(err error) error {
+	if stderrors.Is(err, ErrX) {
+		return errors.New("x")
+	}
+	return nil
+}
+`,
+	},
+}
+
+func TestAnalyzer(t *testing.T) {
+	dir := t.TempDir()
+	input := `package foo
+
+import (
+	"fmt"
+	"os"
+)
+
+func read(name string) ([]byte, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func open(name string) error {
+	_, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("open %s: %v", name, err)
+	}
+	return nil
+}
+`
+	output := `package foo
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+)
+
+func read(name string) ([]byte, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b, nil
+}
+
+func open(name string) error {
+	_, err := os.Open(name)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", name)
+	}
+	return nil
+}
+`
+	name := filepath.Join(dir, "foo.go")
+	require.Nil(t, os.WriteFile(filepath.Join(dir, ConfigFileName), []byte("root: true\nmode: pkg\n"), 0644))
+	require.Nil(t, os.WriteFile(name, []byte(input), 0644))
+
+	fset := token.NewFileSet()
+	af, err := parser.ParseFile(fset, name, input, parser.ParseComments)
+	require.Nil(t, err)
+	info := &types.Info{Types: map[ast.Expr]types.TypeAndValue{}, Defs: map[*ast.Ident]types.Object{}, Uses: map[*ast.Ident]types.Object{}}
+	conf := types.Config{Importer: importer.Default(), Error: func(error) {}}
+	pkg, _ := conf.Check("foo", fset, []*ast.File{af}, info)
+
+	var diags []analysis.Diagnostic
+	pass := &analysis.Pass{
+		Analyzer:  newAnalyzer(),
+		Fset:      fset,
+		Files:     []*ast.File{af},
+		Pkg:       pkg,
+		TypesInfo: info,
+		Report:    func(d analysis.Diagnostic) { diags = append(diags, d) },
+	}
+	_, err = pass.Analyzer.Run(pass)
+	require.Nil(t, err)
+	require.Len(t, diags, 2)
+	require.Equal(t, "withstack", diags[0].Category)
+	require.Equal(t, 11, fset.Position(diags[0].Pos).Line)
+	require.Equal(t, "wrapf", diags[1].Category)
+	require.Equal(t, 19, fset.Position(diags[1].Pos).Line)
+
+	// Every fix imports github.com/pkg/errors, so that it compiles on its own,
+	// and the identical edits of the fixes are merged when they are applied together.
+	var edits []analysis.TextEdit
+	type key struct {
+		pos, end token.Pos
+		text     string
+	}
+	seen := map[key]bool{}
+	for _, d := range diags {
+		require.Len(t, d.SuggestedFixes[0].TextEdits, 2)
+		for _, fix := range d.SuggestedFixes {
+			for _, e := range fix.TextEdits {
+				k := key{e.Pos, e.End, string(e.NewText)}
+				if !seen[k] {
+					seen[k] = true
+					edits = append(edits, e)
+				}
+			}
+		}
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].Pos > edits[j].Pos
+	})
+	tf := fset.File(af.Pos())
+	result := input
+	for _, e := range edits {
+		result = result[:tf.Offset(e.Pos)] + string(e.NewText) + result[tf.Offset(e.End):]
+	}
+	require.Equal(t, output, result)
+}
+
+func TestAnalyzerDriver(t *testing.T) {
+	analysistest.RunWithSuggestedFixes(t, analysistest.TestData(), newAnalyzer(), "analyzer")
+}
+
+func TestJSONWriter(t *testing.T) {
+	input := `package foo
+
+func foo() error {
+	return err
+}
+`
+	name := filepath.Join(t.TempDir(), "foo.go")
+	require.Nil(t, os.WriteFile(name, []byte(input), 0644))
+	w := NewJSONWriter(true)
+	ef := NewErrFix(NewReader(name), NewProcessor(), w)
+	err := ef.Process(context.Background())
+	require.Nil(t, err)
+
+	r := w.Report()
+	require.Equal(t, []Finding{{
+		File:        name,
+		Start:       Position{Line: 4, Column: 9, Offset: 40},
+		End:         Position{Line: 4, Column: 12, Offset: 43},
+		Rule:        "withstack",
+		Message:     "wrap returned errors with errors.WithStack",
+		Original:    "err",
+		Replacement: "errors.WithStack(err)",
+		Imports: []Replacement{{
+			Start:       Position{Line: 3, Column: 1, Offset: 13},
+			End:         Position{Line: 3, Column: 1, Offset: 13},
+			Replacement: "import (\n\t\"github.com/pkg/errors\"\n)\n\n",
+		}},
+		Written: true,
+	}}, r.Findings)
+	require.Equal(t, Summary{Files: 1, Findings: 1, Rules: map[string]int{"withstack": 1}}, r.Summary)
+	content, err := os.ReadFile(name)
+	require.Nil(t, err)
+	require.Contains(t, string(content), "return errors.WithStack(err)")
+	require.True(t, w.Changed())
+
+	// Files changed only by edits without a rule have no findings, but they count as changed.
+	w = NewJSONWriter(false)
+	f := &File{Name: "foo.go", Content: "package foo\n"}
+	f2 := &File{Name: "foo.go", Content: "package foo\n\nimport \"errors\"\n", Edits: []Edit{{Message: "update imports"}}}
+	require.Nil(t, w.Write(context.Background(), f, f2))
+	require.True(t, w.Changed())
+	require.Equal(t, Summary{Files: 1, Findings: 0, Rules: map[string]int{}}, w.Report().Summary)
+}
+
+func TestSARIFWriter(t *testing.T) {
+	input := `package foo
+
+func foo() error {
+	return err
+}
+`
+	w := NewSARIFWriter(false)
+	f := &File{Name: "foo.go", Content: input}
+	f2, err := NewProcessor().Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Nil(t, w.Write(context.Background(), f, f2))
+
+	log := w.Log()
+	require.Equal(t, "2.1.0", log.Version)
+	run := log.Runs[0]
+	require.Len(t, run.Results, 1)
+	r := run.Results[0]
+	require.Equal(t, "withstack", r.RuleID)
+	require.Equal(t, "withstack", run.Tool.Driver.Rules[r.RuleIndex].ID)
+	region := SARIFRegion{StartLine: 4, StartColumn: 9, EndLine: 4, EndColumn: 12}
+	require.Equal(t, SARIFPhysicalLocation{ArtifactLocation: SARIFArtifactLocation{URI: "foo.go"}, Region: region}, r.Locations[0].PhysicalLocation)
+	replacements := r.Fixes[0].ArtifactChanges[0].Replacements
+	require.Len(t, replacements, 2)
+	require.Equal(t, "import (\n\t\"github.com/pkg/errors\"\n)\n\n", replacements[0].InsertedContent.Text)
+	require.Equal(t, SARIFReplacement{DeletedRegion: region, InsertedContent: SARIFMessage{Text: "errors.WithStack(err)"}}, replacements[1])
+	require.Equal(t, 7, runeColumn("\t\"é\", err", 7, 8))
+
+	// Every fix that uses github.com/pkg/errors imports it, and the others are left without the import.
+	input = "package foo\n\nfunc foo() error {\n\treturn fmt.Errorf(\"foo: %v\", err)\n}\n\nfunc bar() error {\n\treturn err\n}\n\nfunc baz() error {\n\treturn fmt.Errorf(\"baz: %s\", err)\n}\n"
+	w = NewSARIFWriter(false)
+	f = &File{Name: "foo.go", Content: input}
+	withStack, _ := LookupRule("withstack")
+	errorfW, _ := LookupRule("errorf-w")
+	f2, err = NewProcessor(WithRuleSet(withStack, errorfW)).Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Nil(t, w.Write(context.Background(), f, f2))
+	results := w.Log().Runs[0].Results
+	require.Len(t, results, 3)
+	for _, r := range results {
+		replacements := r.Fixes[0].ArtifactChanges[0].Replacements
+		if r.RuleID == "withstack" {
+			require.Len(t, replacements, 2)
+			require.Contains(t, replacements[0].InsertedContent.Text, "github.com/pkg/errors")
+		} else {
+			require.Len(t, replacements, 1)
+		}
+	}
+}
+
+func TestStatWriter(t *testing.T) {
+	w := NewStatWriter(false)
+	inputs := map[string]string{
+		"b.go": "package foo\n\nfunc foo() error {\n\treturn err\n}\n",
+		"a.go": "package foo\n\nfunc foo() error {\n\tif err != nil {\n\t\treturn fmt.Errorf(\"foo: %v\", err)\n\t}\n\treturn err\n}\n",
+		"c.go": "package foo\n",
+	}
+	for name, input := range inputs {
+		f := &File{Name: name, Content: input}
+		f2, err := NewProcessor().Process(context.Background(), f)
+		require.Nil(t, err)
+		require.Nil(t, w.Write(context.Background(), f, f2))
+	}
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, w.List(buf))
+	require.Equal(t, "a.go\nb.go\n", buf.String())
+	buf.Reset()
+	require.Nil(t, w.Table(buf))
+	table := `file   withstack  wrapf  total
+a.go   1          1      2
+b.go   1          0      1
+total  2          1      3
+`
+	require.Equal(t, table, buf.String())
+
+	// The rewrites of adjacent lines are counted even when they make a single edit.
+	input := "package foo\n\nfunc foo() bool {\n\te, ok := err.(*T)\n\tif err == ErrX {\n\t\treturn ok\n\t}\n\treturn e == nil\n}\n"
+	f := &File{Name: "d.go", Content: input}
+	f2, err := NewProcessor(WithMode(ModeStdErrors)).Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"as": 1, "is": 1}, f2.Rewrites)
+	w = NewStatWriter(false)
+	require.Nil(t, w.Write(context.Background(), f, f2))
+	require.Equal(t, map[string]int{"as": 1, "is": 1}, w.Stats()[0].Rules)
+	j := NewJSONWriter(false)
+	require.Nil(t, j.Write(context.Background(), f, f2))
+	require.Equal(t, map[string]int{"as": 1, "is": 1}, j.Report().Summary.Rules)
+
+	// Assertions that are left unchanged are neither counted nor recorded in the baseline.
+	input = "package foo\n\nfunc foo() {\n\t_, _ = err.(*T)\n\t_, _ = err.(*T)\n\t_, _ = err.(*T)\n}\n"
+	record := NewBaseline()
+	f = &File{Name: "e.go", Content: input}
+	f2, err = NewProcessor(WithMode(ModeStdErrors), WithBaselineRecord(record)).Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Equal(t, input, f2.Content)
+	require.Empty(t, f2.Rewrites)
+	require.Empty(t, record.Entries(""))
+
+	// The calls of errors.New are counted only when their message is restyled or their import is switched.
+	input = "package foo\n\nimport \"github.com/pkg/errors\"\n\nfunc foo() error {\n\tif bar() {\n\t\treturn errors.New(\"Bar\")\n\t}\n\treturn errors.New(\"baz\")\n}\n"
+	f = &File{Name: "f.go", Content: input}
+	f2, err = NewProcessor().Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Equal(t, input, f2.Content)
+	require.Empty(t, f2.Rewrites)
+	f2, err = NewProcessor(WithMessageStyle(MessageStyleLower)).Process(context.Background(), f)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"wrapf": 1}, f2.Rewrites)
+	stdInput := strings.Replace(input, "\"github.com/pkg/errors\"", "\"errors\"", 1)
+	f2, err = NewProcessor().Process(context.Background(), &File{Name: "f.go", Content: stdInput})
+	require.Nil(t, err)
+	require.Equal(t, input, f2.Content)
+	require.Equal(t, map[string]int{"wrapf": 2}, f2.Rewrites)
+}
+
+// slowProcessor finishes the files in the reverse order of their names.
+type slowProcessor struct {
+	p Processor
+}
+
+func (p slowProcessor) Process(ctx context.Context, f *File) (*File, error) {
+	n, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(f.Name), ".go"))
+	time.Sleep(time.Duration(10-n) * 5 * time.Millisecond)
+	return p.p.Process(ctx, f)
+}
+
+func TestDiffWriterOrder(t *testing.T) {
+	dir := t.TempDir()
+	var names []interface{}
+	for i := 0; i < 10; i++ {
+		name := filepath.Join(dir, strconv.Itoa(i)+".go")
+		require.Nil(t, os.WriteFile(name, []byte("package foo\n\nfunc foo() error {\n\treturn err\n}\n"), 0644))
+		names = append(names, name)
+	}
+	// The files are given out of order on purpose.
+	names[2], names[7] = names[7], names[2]
+
+	w := NewDiffWriter(false)
+	buf := &bytes.Buffer{}
+	sw := NewStreamDiffWriter(buf, false)
+	require.Nil(t, NewErrFix(NewReader(names...), slowProcessor{NewProcessor()}, w).Process(context.Background()))
+	require.Nil(t, NewErrFix(NewReader(names...), slowProcessor{NewProcessor()}, sw).Process(context.Background()))
+
+	headers := func(diff string) []string {
+		var files []string
+		for _, line := range strings.Split(diff, "\n") {
+			if strings.HasPrefix(line, "--- ") {
+				files = append(files, strings.TrimSuffix(filepath.Base(line), ".go#original"))
+			}
+		}
+		return files
+	}
+	require.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, headers(w.DiffString()))
+	require.Equal(t, []string{"0", "1", "7", "3", "4", "5", "6", "2", "8", "9"}, headers(buf.String()))
+	require.True(t, sw.Changed())
+	require.Equal(t, "", sw.DiffString())
+}
+
+func TestPatchWriter(t *testing.T) {
+	root := t.TempDir()
+	require.Nil(t, os.Mkdir(filepath.Join(root, ".git"), 0755))
+	input := "package foo\n\nfunc foo() error {\n\treturn err\n}\n"
+	var names []interface{}
+	for _, name := range []string{"svc/store/foo.go", "foo.go"} {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		require.Nil(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.Nil(t, os.WriteFile(name, []byte(input), 0644))
+		names = append(names, name)
+	}
+
+	w := NewPatchWriter(false)
+	require.Nil(t, NewErrFix(NewReader(names...), NewProcessor(), w).Process(context.Background()))
+	patch := `diff --git a/foo.go b/foo.go
+--- a/foo.go
++++ b/foo.go
+@@ -1,5 +1,9 @@
+ package foo
+ 
++import (
++	"github.com/pkg/errors"
++)
++
+ func foo() error {
+-	return err
++	return errors.WithStack(err)
+ }
+`
+	require.Equal(t, patch+strings.ReplaceAll(patch, "foo.go", "svc/store/foo.go"), w.Patch())
+
+	dir := filepath.Join(t.TempDir(), "patches")
+	files, err := w.WriteDir(dir, true)
+	require.Nil(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "root.patch"), filepath.Join(dir, "svc_store.patch")}, files)
+	files, err = w.WriteDir(dir, false)
+	require.Nil(t, err)
+	require.Equal(t, []string{filepath.Join(dir, PatchFileName)}, files)
+	content, err := os.ReadFile(files[0])
+	require.Nil(t, err)
+	require.Equal(t, w.Patch(), string(content))
+
+	// Directories whose paths only differ by their separators get their own patches.
+	require.Equal(t, "pkg_store.patch", patchName("pkg/store/foo.go"))
+	require.Equal(t, "pkg%5Fstore.patch", patchName("pkg_store/foo.go"))
+	require.Equal(t, ".._dev.patch", patchName("../dev/stdin"))
+	w = NewPatchWriter(false)
+	w.patches = []filePatch{{path: "root/foo.go", text: "root\n"}, {path: "foo.go", text: "foo\n"}}
+	_, err = w.WriteDir(dir, true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "the patches of . and root are both named root.patch")
+
+	// The last line of a file without a final newline is marked as such.
+	name := filepath.Join(root, "bar.go")
+	require.Nil(t, os.WriteFile(name, []byte(strings.TrimSuffix(input, "\n")), 0644))
+	w = NewPatchWriter(false)
+	require.Nil(t, NewErrFix(NewReader(name), NewProcessor(), w).Process(context.Background()))
+	patch = `diff --git a/bar.go b/bar.go
+--- a/bar.go
++++ b/bar.go
+@@ -1,5 +1,9 @@
+ package foo
+ 
++import (
++	"github.com/pkg/errors"
++)
++
+ func foo() error {
+-	return err
+-}
+\ No newline at end of file
++	return errors.WithStack(err)
++}
+`
+	require.Equal(t, patch, w.Patch())
+}
+
+// failWriter fails to write the files whose name contains fail.
+type failWriter struct {
+	Writer
+}
+
+func (w failWriter) Write(ctx context.Context, f *File, f2 *File) error {
+	if strings.Contains(f.Name, "fail") {
+		return errors.New("read-only file")
+	}
+	return w.Writer.Write(ctx, f, f2)
+}
+
+func TestErrFixKeepGoing(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"bad.go":  "package foo\nfunc {\n",
+		"fail.go": "package foo\n\nfunc foo() error {\n\treturn err\n}\n",
+		"good.go": "package foo\n\nfunc foo() error {\n\treturn err\n}\n",
+	}
+	for name, content := range files {
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	w := NewStatWriter(false)
+	err := NewErrFix(NewReader(dir), NewProcessor(), failWriter{w}).Process(context.Background())
+	var fe *FileError
+	require.True(t, errors.As(err, &fe))
+
+	w = NewStatWriter(false)
+	err = NewErrFix(NewReader(dir), NewProcessor(), failWriter{w}, WithKeepGoing(true)).Process(context.Background())
+	var errs FileErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+	require.Equal(t, filepath.Join(dir, "bad.go"), errs[0].Name)
+	require.Equal(t, OpProcess, errs[0].Op)
+	require.Equal(t, filepath.Join(dir, "fail.go"), errs[1].Name)
+	require.Equal(t, OpWrite, errs[1].Op)
+	require.Equal(t, "error while writing "+filepath.Join(dir, "fail.go")+", read-only file", errs[1].Error())
+	require.Len(t, w.Stats(), 1)
+	require.Equal(t, filepath.Join(dir, "good.go"), w.Stats()[0].Name)
+}
+
+// cancelWriter cancels the context after the first file.
+type cancelWriter struct {
+	cancel context.CancelFunc
+}
+
+func (w cancelWriter) Write(ctx context.Context, f *File, f2 *File) error {
+	w.cancel()
+	return nil
+}
+
+// blockingProcessor waits for the end of the context.
+type blockingProcessor struct{}
+
+func (blockingProcessor) Process(ctx context.Context, f *File) (*File, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// stuckProcessor ignores the context, and waits until release is closed.
+type stuckProcessor struct {
+	release chan struct{}
+}
+
+func (p stuckProcessor) Process(ctx context.Context, f *File) (*File, error) {
+	<-p.release
+	return f, nil
+}
+
+func TestErrFixContext(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 50; i++ {
+		name := filepath.Join(dir, strconv.Itoa(i)+".go")
+		require.Nil(t, os.WriteFile(name, []byte("package foo\n"), 0644))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := NewErrFix(NewReader(dir), NewProcessor(), cancelWriter{cancel}).Process(ctx)
+	require.Equal(t, context.Canceled, err)
+
+	// The reader stops without a consumer once the context is done.
+	ctx, cancel = context.WithCancel(context.Background())
+	ch, err := NewReader(dir).Read(ctx)
+	require.Nil(t, err)
+	cancel()
+	n := 0
+	for range ch {
+		n++
+	}
+	require.Less(t, n, 50)
+
+	err = NewErrFix(NewReader(dir), blockingProcessor{}, NewStatWriter(false),
+		WithKeepGoing(true), WithFileTimeout(time.Millisecond)).Process(context.Background())
+	var errs FileErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 50)
+	require.True(t, errors.Is(errs[0], context.DeadlineExceeded))
+
+	// The timeout applies to processors that do not check the context.
+	release := make(chan struct{})
+	defer close(release)
+	err = NewErrFix(NewReader(filepath.Join(dir, "0.go")), stuckProcessor{release}, NewStatWriter(false),
+		WithFileTimeout(time.Millisecond)).Process(context.Background())
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestTypeCheckerLoadContext(t *testing.T) {
+	c := newTypeChecker()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.load(ctx, "testdata/types")
+	require.Equal(t, context.Canceled, err)
+
+	// The failure of the canceled context is not kept for the next files of the directory.
+	pkgs, err := c.load(context.Background(), "testdata/types")
+	require.Nil(t, err)
+	require.NotEmpty(t, pkgs)
+}
+
+func TestTypeCheckerPackageCache(t *testing.T) {
+	c := newTypeChecker()
+	check := func(name, content string) *types.Info {
+		_, _, info, _, err := c.check(context.Background(), &File{Name: name, Content: content})
+		require.Nil(t, err)
+		return info
+	}
+	read := func(name string) string {
+		content, err := os.ReadFile(name)
+		require.Nil(t, err)
+		return string(content)
+	}
+
+	// The files of a package share the type information of a single check.
+	info := check("testdata/types/types.go", read("testdata/types/types.go"))
+	require.True(t, info == check("testdata/types/check.go", read("testdata/types/check.go")))
+
+	// A content that is not the one on disk is checked with the other files of the package.
+	content := strings.Replace(read("testdata/types/types.go"), "return err\n", "return err + \"\"\n", 1)
+	info2 := check("testdata/types/types.go", content)
+	require.False(t, info == info2)
+	found := false
+	for id, obj := range info2.Uses {
+		if id.Name == "check" {
+			_, found = obj.(*types.Func)
+		}
+	}
+	require.True(t, found)
+}
+
+func TestReaderPackages(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":                 "module example.com/foo\n\ngo 1.18\n",
+		"foo.go":                 "package foo\n",
+		"foo_test.go":            "package foo\n",
+		"tagged.go":              "//go:build integration\n\npackage foo\n",
+		"bar/bar.go":             "package bar\n",
+		"vendor/baz/baz.go":      "package baz\n",
+		"testdata/qux.go":        "package qux\n",
+		"nested/go.mod":          "module example.com/nested\n\ngo 1.18\n",
+		"nested/nested.go":       "package nested\n",
+		"bar/testdata/broken.go": "package",
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.Nil(t, os.WriteFile(name, []byte(content), 0644))
+	}
+
+	read := func(pkgs Packages) []string {
+		ch, err := NewReader(pkgs).Read(context.Background())
+		require.Nil(t, err)
+		var names []string
+		for f := range ch {
+			require.Nil(t, f.Error)
+			rel, err := filepath.Rel(dir, f.Name)
+			require.Nil(t, err)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return names
+	}
+	require.Equal(t, []string{"bar/bar.go", "foo.go", "foo_test.go"}, read(Packages{Patterns: []string{"./..."}, Dir: dir}))
+	require.Equal(t, []string{"bar/bar.go", "foo.go", "foo_test.go", "tagged.go"},
+		read(Packages{Patterns: []string{"./..."}, BuildFlags: []string{"-tags=integration"}, Dir: dir}))
+	require.Equal(t, []string{"bar/bar.go"}, read(Packages{Patterns: []string{"example.com/foo/bar"}, Dir: dir}))
+
+	require.True(t, IsPattern("./..."))
+	require.True(t, IsPattern("github.com/org/repo/pkg"))
+	require.False(t, IsPattern(dir))
+	require.False(t, IsPattern("missing.go"))
+	require.False(t, IsPattern("./missing"))
+	require.False(t, IsPattern(filepath.Join(dir, "missing")))
+	_, err := NewReader("./missing").Read(context.Background())
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no such file or directory")
+
+	// The packages that cannot be loaded are read as failed files, before the files of the others.
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "broken"), 0755))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "broken/broken.go"), []byte("//go:build (linux\n\npackage broken\n"), 0644))
+	ch, err := NewReader(Packages{Patterns: []string{"./..."}, Dir: dir}).Read(context.Background())
+	require.Nil(t, err)
+	var names []string
+	for f := range ch {
+		if f.Error != nil {
+			require.Contains(t, f.Error.Error(), "error loading package example.com/foo/broken")
+			names = append(names, f.Name)
+			continue
+		}
+		rel, err := filepath.Rel(dir, f.Name)
+		require.Nil(t, err)
+		names = append(names, filepath.ToSlash(rel))
+	}
+	require.Equal(t, []string{"example.com/foo/broken", "bar/bar.go", "foo.go", "foo_test.go"}, names)
+}
+
+func TestReaderFilters(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".git/HEAD":                "",
+		".gitignore":               "/build/\n*.tmp.go\n!keep.tmp.go\n",
+		"foo.go":                   "package foo\n",
+		"foo.pb.go":                "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage foo\n",
+		"doc.go":                   "// Package foo says Code generated ... DO NOT EDIT. in a sentence.\npackage foo\n",
+		"foo_mock.go":              "package foo\n",
+		"a.tmp.go":                 "package foo\n",
+		"keep.tmp.go":              "package foo\n",
+		"build/out.go":             "package build\n",
+		"internal/legacy/old.go":   "package legacy\n",
+		"internal/legacy/x/old.go": "package x\n",
+		"internal/api/api.go":      "package api\n",
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.Nil(t, os.WriteFile(name, []byte(content), 0644))
+	}
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Nil(t, os.Chdir(dir))
+	defer func() {
+		require.Nil(t, os.Chdir(wd))
+	}()
+
+	read := func(inputs ...interface{}) []string {
+		ch, err := NewReader(inputs...).Read(context.Background())
+		require.Nil(t, err)
+		var names []string
+		for f := range ch {
+			require.Nil(t, f.Error)
+			names = append(names, filepath.ToSlash(f.Name))
+		}
+		return names
+	}
+	require.Equal(t, []string{"a.tmp.go", "build/out.go", "doc.go", "foo.go", "foo_mock.go",
+		"internal/api/api.go", "internal/legacy/old.go", "internal/legacy/x/old.go", "keep.tmp.go"}, read("."))
+	require.Contains(t, read(".", WithGenerated(true)), "foo.pb.go")
+	require.Equal(t, []string{"a.tmp.go", "build/out.go", "doc.go", "foo.go", "internal/api/api.go", "keep.tmp.go"},
+		read(".", WithExclude("internal/legacy/**", "*_mock.go")))
+	require.Equal(t, []string{"internal/api/api.go", "internal/legacy/old.go"},
+		read(".", WithInclude("internal/*/*.go")))
+	require.Equal(t, []string{"doc.go", "foo.go", "foo_mock.go", "internal/api/api.go", "keep.tmp.go"},
+		read(".", WithExclude("legacy"), WithGitignore(true)))
+
+	_, err = NewReader(".", WithExclude("[")).Read(context.Background())
+	require.NotNil(t, err)
+
+	require.True(t, isGenerated("// Code generated by mockgen. DO NOT EDIT.\r\npackage foo\n"))
+	require.False(t, isGenerated("package foo\n\n// Code generated by mockgen. DO NOT EDIT.\n"))
+}
+
+func TestChangedLines(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "foo.go")
+	content := "package foo\n\nfunc foo() error {\n\terr := bar()\n\tif err != nil {\n\t\treturn err\n\t}\n\treturn err\n}\n"
+	require.Nil(t, os.WriteFile(name, []byte(content), 0644))
+
+	changes := &Changes{Files: map[string][]LineRange{name: {{Start: 8, End: 8}}}}
+	p := NewProcessor(WithChangedLines(changes))
+	f2, err := p.Process(context.Background(), &File{Name: name, Content: content})
+	require.Nil(t, err)
+	require.Contains(t, f2.Content, "\t\treturn err\n")
+	require.Contains(t, f2.Content, "\treturn errors.WithStack(err)\n")
+	require.Len(t, f2.Edits, 2)
+
+	// Directives outside of the changed lines are not reported as unused.
+	ignored := strings.Replace(content, "\t\treturn err\n", "\t\treturn err //errfix:ignore\n", 1)
+	f2, err = p.Process(context.Background(), &File{Name: name, Content: ignored})
+	require.Nil(t, err)
+	require.Contains(t, f2.Content, "\t\treturn err //errfix:ignore\n")
+	require.Empty(t, f2.Notes)
+
+	// A file that did not change is left as it is.
+	f2, err = p.Process(context.Background(), &File{Name: filepath.Join(dir, "bar.go"), Content: content})
+	require.Nil(t, err)
+	require.Equal(t, content, f2.Content)
+
+	ch, err := NewReader(dir, WithChangedFiles(&Changes{})).Read(context.Background())
+	require.Nil(t, err)
+	n := 0
+	for range ch {
+		n++
+	}
+	require.Equal(t, 0, n)
+
+	c, err := parseGitDiff(dir, "diff --git a/foo.go b/foo.go\n--- a/foo.go\n+++ b/foo.go\n@@ -3 +3 @@ x\n-a\n+b\n@@ -10,2 +9,0 @@\n-c\n-d\n@@ -20,0 +20,3 @@\n+e\n+f\n+g\n"+
+		"diff --git a/bar.go b/bar.go\n--- a/bar.go\n+++ /dev/null\n@@ -1 +0,0 @@\n-package bar\n")
+	require.Nil(t, err)
+	require.Equal(t, map[string][]LineRange{name: {{Start: 3, End: 3}, {Start: 20, End: 22}}}, c.Files)
+	require.True(t, c.Changed(name))
+	require.False(t, c.Changed(filepath.Join(dir, "bar.go")))
+}
+
+func TestGitChanges(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Nil(t, os.Chdir(dir))
+	defer func() {
+		require.Nil(t, os.Chdir(wd))
+	}()
+	run := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@b", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@b")
+		out, err := cmd.CombinedOutput()
+		require.Nil(t, err, string(out))
+	}
+	run("init", "-q")
+	require.Nil(t, os.WriteFile("foo.go", []byte("package foo\n\nvar a = 1\n"), 0644))
+	require.Nil(t, os.WriteFile("same.go", []byte("package foo\n"), 0644))
+	run("add", ".")
+	run("commit", "-q", "-m", "init")
+	require.Nil(t, os.WriteFile("foo.go", []byte("package foo\n\nvar a = 2\nvar b = 3\n"), 0644))
+	require.Nil(t, os.WriteFile("new.go", []byte("package foo\n"), 0644))
+
+	c, err := GitChanges(context.Background(), "HEAD")
+	require.Nil(t, err)
+	root, err := filepath.EvalSymlinks(dir)
+	require.Nil(t, err)
+	require.Equal(t, []string{filepath.Join(root, "foo.go"), filepath.Join(root, "new.go")}, c.Names())
+	require.Equal(t, []LineRange{{Start: 3, End: 4}}, c.Lines("foo.go"))
+	require.True(t, c.Changed("new.go"))
+	require.False(t, c.Changed("same.go"))
+
+	_, err = GitChanges(context.Background(), "no-such-revision")
+	require.NotNil(t, err)
+}
+
+func TestBaseline(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "foo.go")
+	content := "package foo\n\ntype Store struct{}\n\nfunc (s *Store) Get() error {\n\terr := bar()\n\tif err != nil {\n\t\treturn err\n\t}\n\treturn nil\n}\n"
+	require.Nil(t, os.WriteFile(name, []byte(content), 0644))
+
+	record := NewBaseline()
+	ef := NewErrFix(NewReader(name), NewProcessor(WithBaselineRecord(record)), NewStatWriter(false))
+	require.Nil(t, ef.Process(context.Background()))
+	require.Equal(t, []BaselineEntry{{File: "foo.go", Function: "Store.Get", Rule: ruleWithStack, Code: "return err", Count: 1}}, record.Entries(dir))
+	baselineName := filepath.Join(dir, "baseline.json")
+	require.Nil(t, record.Save(baselineName))
+
+	baseline, err := LoadBaseline(baselineName)
+	require.Nil(t, err)
+	p := NewProcessor(WithBaseline(baseline))
+	// Lines added above the rewrite do not matter.
+	shifted := strings.Replace(content, "type Store struct{}\n", "type Store struct{}\n\nvar x = 1\n", 1)
+	f2, err := p.Process(context.Background(), &File{Name: name, Content: shifted})
+	require.Nil(t, err)
+	require.Equal(t, shifted, f2.Content)
+
+	// New rewrites are made.
+	added := strings.Replace(content, "\treturn nil\n}", "\tif err := baz(); err != nil {\n\t\treturn err\n\t}\n\treturn nil\n}", 1)
+	f2, err = p.Process(context.Background(), &File{Name: name, Content: added})
+	require.Nil(t, err)
+	require.Equal(t, 1, strings.Count(f2.Content, "errors.WithStack(err)"))
+	require.Contains(t, f2.Content, "\tif err := baz(); err != nil {\n\t\treturn errors.WithStack(err)\n")
+
+	// Asking again whether a node is ignored does not use up another occurrence of the baseline.
+	newWithStack, err := LookupRule(ruleWithStack)
+	require.Nil(t, err)
+	p = NewProcessor(WithBaseline(baseline), WithRuleSet(func() Rule { return askTwiceRule{newWithStack()} }))
+	f2, err = p.Process(context.Background(), &File{Name: name, Content: added})
+	require.Nil(t, err)
+	require.Equal(t, 1, strings.Count(f2.Content, "errors.WithStack(err)"))
+}
+
+// askTwiceRule asks whether the returns are ignored before running its rule, which asks again.
+type askTwiceRule struct {
+	Rule
+}
+
+func (r askTwiceRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	if _, ok := n.(*dst.ReturnStmt); ok {
+		p.Ignored(n)
+	}
+	return r.Rule.Process(ctx, p, n)
+}
+
+func TestErrFixModernize(t *testing.T) {
+	cfg := &Config{Rules: []string{"modernize"}}
+	p, err := cfg.Processor()
+	require.Nil(t, err)
+	for _, c := range testModernizeCases {
+		f2, err := p.Process(context.Background(), &File{Name: c.Name, Content: c.Input})
+		msg := c.Name + " " + c.Desc
+		require.Nil(t, err, msg)
+		require.Equal(t, c.Output, f2.Content, msg)
+		content, err := ApplyEdits(c.Input, f2.Edits)
+		require.Nil(t, err, msg)
+		require.Equal(t, f2.Content, content, msg)
+	}
+
+	input := `package foo
+
+import "github.com/pkg/errors"
+
+func foo(err error) int {
+	return errors.Cause(err).(*MyErr).Code
+}
+`
+	f2, err := p.Process(context.Background(), &File{Name: "foo.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, input, f2.Content)
+	require.Len(t, f2.Notes, 1)
+	require.Equal(t, "foo.go:6:9: type assertion left unchanged: only the two-value form can become errors.As (cause-as)", f2.Notes[0].String())
+
+	input = `package foo
+
+import "github.com/pkg/errors"
+
+func foo(err error) bool {
+	_, ok := errors.Cause(err).(*MyErr) //errfix:ignore cause-as
+	return ok
+}
+`
+	f2, err = p.Process(context.Background(), &File{Name: "foo.go", Content: input})
+	require.Nil(t, err)
+	require.Equal(t, input, f2.Content)
+	require.Empty(t, f2.Notes)
+}
+
+var testModernizeCases = []normalCase{
+	{
+		"Modernize#1",
+		"comparisons through errors.Cause become errors.Is",
+		`package foo
+
+import "github.com/pkg/errors"
+
+func foo() error {
+	err := bar()
+	if errors.Cause(err) == ErrNotFound {
+		return nil
+	}
+	if err != nil && errors.Cause(err) != ErrExist {
+		return err
+	}
+	found := errors.Cause(err) == ErrNotFound
+	if errors.Cause(err) == nil {
+		return nil
+	}
+	return err
+}
+`,
+		`package foo
+
+import "github.com/pkg/errors"
+
+func foo() error {
+	err := bar()
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrExist) {
+		return err
+	}
+	found := errors.Is(err, ErrNotFound)
+	if errors.Cause(err) == nil {
+		return nil
+	}
+	return err
+}
+`,
+	},
+	{
+		"Modernize#2",
+		"two-value type assertions through errors.Cause become errors.As",
+		`package foo
+
+import "github.com/pkg/errors"
+
+func foo() error {
+	err := bar()
+	// The error of the store.
+	if e, ok := errors.Cause(err).(*StoreError); ok {
+		return e.Err
+	} else {
+		return nil
+	}
+	pe, ok := errors.Cause(err).(*os.PathError)
+	_, ok = errors.Cause(err).(*os.LinkError)
+	return nil
+}
+`,
+		`package foo
+
+import "github.com/pkg/errors"
+
+func foo() error {
+	err := bar()
+	// The error of the store.
+	if e := (*StoreError)(nil); errors.As(err, &e) {
+		return e.Err
+	} else {
+		return nil
+	}
+	var pe *os.PathError
+	ok := errors.As(err, &pe)
+	ok = errors.As(err, new(*os.LinkError))
+	return nil
+}
+`,
+	},
+	{
+		"Modernize#4",
+		"else branches are converted too, and each target stays scoped to its if statement",
+		`package foo
+
+import "github.com/pkg/errors"
+
+func foo(err error) error {
+	if e, ok := errors.Cause(err).(*StoreError); ok {
+		return e.Err
+	} else if e, ok := errors.Cause(err).(*CacheError); ok {
+		return e.Err
+	}
+	return nil
+}
+`,
+		`package foo
+
+import "github.com/pkg/errors"
+
+func foo(err error) error {
+	if e := (*StoreError)(nil); errors.As(err, &e) {
+		return e.Err
+	} else if e := (*CacheError)(nil); errors.As(err, &e) {
+		return e.Err
+	}
+	return nil
+}
+`,
+	},
+	{
+		"Modernize#3",
+		"switches on errors.Cause become errors.Is and errors.As",
+		`package foo
+
+import "github.com/pkg/errors"
+
+func foo() error {
+	err := bar()
+	switch errors.Cause(err) {
+	case ErrNotFound:
+		return nil
+	}
+	switch e := errors.Cause(err).(type) {
+	case *StoreError:
+		return e.Err
+	}
+	return nil
+}
+`,
+		`package foo
+
+import "github.com/pkg/errors"
+
+func foo() error {
+	err := bar()
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return nil
+	}
+	if e := (*StoreError)(nil); errors.As(err, &e) {
+		return e.Err
+	}
+	return nil
+}
 `,
 	},
 }
@@ -0,0 +1,262 @@
+package errfix
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ReaderOption configures the Reader returned by NewReader. Options are given among the inputs of NewReader.
+type ReaderOption func(*reader)
+
+// WithGenerated reads generated files too. By default, files with a "// Code generated ... DO NOT EDIT." comment
+// before the package clause, such as *.pb.go or mockgen output, are skipped, since the next run of the generator
+// would revert the rewrites.
+func WithGenerated(enabled bool) ReaderOption {
+	return func(r *reader) {
+		r.generated = enabled
+	}
+}
+
+// WithInclude restricts the files read from directories and packages to those matching one of the patterns.
+// Patterns are slash-separated paths relative to the working directory, where * matches within an element
+// and ** matches any number of elements, such as internal/**/*.go. Patterns without a slash match the file name.
+func WithInclude(patterns ...string) ReaderOption {
+	return func(r *reader) {
+		r.include = append(r.include, patterns...)
+	}
+}
+
+// WithExclude skips the files and directories read from directories and packages that match one of the patterns,
+// such as internal/legacy/** or *_mock.go. Patterns are written as for WithInclude, and a pattern that matches
+// a directory excludes all its files.
+func WithExclude(patterns ...string) ReaderOption {
+	return func(r *reader) {
+		r.exclude = append(r.exclude, patterns...)
+	}
+}
+
+// WithGitignore skips the files and directories read from directories that the .gitignore files ignore,
+// as well as the .git directories.
+func WithGitignore(enabled bool) ReaderOption {
+	return func(r *reader) {
+		r.gitignore = enabled
+	}
+}
+
+// generatedRe matches the comment that marks generated files, as documented by go generate.
+var generatedRe = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// isGenerated returns true when a line before the package clause of content is the comment of generated files.
+func isGenerated(content string) bool {
+	s := bufio.NewScanner(strings.NewReader(content))
+	s.Buffer(nil, len(content)+1)
+	for s.Scan() {
+		line := strings.TrimSuffix(s.Text(), "\r")
+		if generatedRe.MatchString(line) {
+			return true
+		}
+		if strings.HasPrefix(line, "package ") {
+			return false
+		}
+	}
+	return false
+}
+
+// validGlob returns an error when pattern is malformed.
+func validGlob(pattern string) error {
+	for _, elem := range strings.Split(pattern, "/") {
+		if _, err := path.Match(elem, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchGlob matches a slash-separated path against a pattern of WithInclude or WithExclude.
+func matchGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchElems(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(name, "/"))
+}
+
+// matchElems matches the elements of a path against the elements of a pattern, where ** matches any number of elements.
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(elems); i >= 0; i-- {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// globName returns the slash-separated name that the patterns match, relative to the working directory when p is below it.
+func globName(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				p = rel
+			}
+		}
+	}
+	return filepath.ToSlash(filepath.Clean(p))
+}
+
+// excluded returns true when the file or directory p, or one of its parent directories, matches an exclude pattern.
+func (r *reader) excluded(p string) bool {
+	if len(r.exclude) == 0 {
+		return false
+	}
+	elems := strings.Split(globName(p), "/")
+	for i := range elems {
+		name := strings.Join(elems[:i+1], "/")
+		for _, pattern := range r.exclude {
+			// internal/legacy/** excludes the directory internal/legacy itself, so that its walk is skipped.
+			if matchGlob(pattern, name) || strings.HasSuffix(pattern, "/**") && matchGlob(strings.TrimSuffix(pattern, "/**"), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// included returns true when the file p matches an include pattern, or when there are none.
+func (r *reader) included(p string) bool {
+	if len(r.include) == 0 {
+		return true
+	}
+	name := globName(p)
+	for _, pattern := range r.include {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// gitignore holds the patterns of the .gitignore files read so far during the walk of a directory.
+type gitignore struct {
+	patterns []gitignorePattern
+	loaded   map[string]bool
+}
+
+type gitignorePattern struct {
+	// dir is the directory of the .gitignore file.
+	dir      string
+	elems    []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// newGitignore returns the patterns of the .gitignore files of the parent directories of dir,
+// up to the root of the git repository.
+func newGitignore(dir string) *gitignore {
+	g := &gitignore{loaded: map[string]bool{}}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return g
+	}
+	var dirs []string
+	if _, err := os.Stat(filepath.Join(abs, ".git")); err != nil {
+		found := false
+		for d := filepath.Dir(abs); ; d = filepath.Dir(d) {
+			dirs = append(dirs, d)
+			if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+				found = true
+				break
+			}
+			if filepath.Dir(d) == d {
+				break
+			}
+		}
+		// Outside of a repository, no .gitignore file applies.
+		if !found {
+			dirs = nil
+		}
+	}
+	// Patterns of deeper files come last, so that they take precedence.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		g.load(dirs[i])
+	}
+	return g
+}
+
+// load reads the .gitignore file of dir once.
+func (g *gitignore) load(dir string) {
+	if g.loaded[dir] {
+		return
+	}
+	g.loaded[dir] = true
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := gitignorePattern{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// A slash at the beginning or in the middle anchors the pattern to the directory of the file.
+		p.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" || validGlob(line) != nil {
+			continue
+		}
+		p.elems = strings.Split(line, "/")
+		g.patterns = append(g.patterns, p)
+	}
+}
+
+// ignored returns true when the absolute path p is ignored. The last matching pattern wins, as with git.
+func (g *gitignore) ignored(p string, isDir bool) bool {
+	ignored := false
+	for _, pattern := range g.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(pattern.dir, p)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		elems := strings.Split(filepath.ToSlash(rel), "/")
+		matched := false
+		if pattern.anchored {
+			matched = matchElems(pattern.elems, elems)
+		} else {
+			ok, _ := path.Match(pattern.elems[0], elems[len(elems)-1])
+			matched = ok
+		}
+		if matched {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
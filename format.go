@@ -0,0 +1,139 @@
+package errfix
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dave/dst"
+)
+
+// formatVerb is a verb of a format string of the fmt package, such as %v or %+[2]s.
+type formatVerb struct {
+	// start and end are the offsets of the verb in the format, from the percent sign to the verb letter included.
+	start, end int
+	flags      string
+	// sized is true when the verb has a width or a precision.
+	sized bool
+	verb  rune
+	// arg is the index of the argument formatted by the verb, among the arguments after the format.
+	arg int
+}
+
+// parseFormat returns the verbs of a format string of the fmt package given nargs arguments, without the escaped
+// percent signs. reordered is true when the format uses argument indexes such as %[2]v.
+// It returns false when the verbs do not match the arguments, which go vet reports.
+func parseFormat(format string, nargs int) (verbs []formatVerb, reordered bool, ok bool) {
+	arg := 0
+	// index parses the argument index at i, such as [2], which sets the next argument.
+	index := func(i int) (int, bool) {
+		if i >= len(format) || format[i] != '[' {
+			return i, true
+		}
+		end := strings.IndexByte(format[i:], ']')
+		if end < 0 {
+			return i, false
+		}
+		n, err := strconv.Atoi(format[i+1 : i+end])
+		if err != nil || n < 1 || n > nargs {
+			return i, false
+		}
+		arg, reordered = n-1, true
+		return i + end + 1, true
+	}
+	// size parses a width or a precision at i, where * takes the next argument.
+	size := func(i int, v *formatVerb) (int, bool) {
+		if i < len(format) && format[i] == '*' {
+			arg++
+			v.sized = true
+			return i + 1, arg <= nargs
+		}
+		j := i
+		for i < len(format) && '0' <= format[i] && format[i] <= '9' {
+			i++
+		}
+		v.sized = v.sized || i > j
+		return i, true
+	}
+
+	for i := 0; i < len(format); {
+		if format[i] != '%' {
+			i++
+			continue
+		}
+		v := formatVerb{start: i}
+		for i++; i < len(format) && strings.IndexByte("+-# 0", format[i]) >= 0; i++ {
+			v.flags += format[i : i+1]
+		}
+		if i, ok = index(i); !ok {
+			return nil, false, false
+		}
+		if i, ok = size(i, &v); !ok {
+			return nil, false, false
+		}
+		if i < len(format) && format[i] == '.' {
+			v.sized = true
+			if i, ok = index(i + 1); !ok {
+				return nil, false, false
+			}
+			if i, ok = size(i, &v); !ok {
+				return nil, false, false
+			}
+		}
+		if i, ok = index(i); !ok {
+			return nil, false, false
+		}
+		if i >= len(format) {
+			return nil, false, false
+		}
+		r, n := utf8.DecodeRuneInString(format[i:])
+		i += n
+		if r == '%' {
+			continue
+		}
+		if arg >= nargs {
+			return nil, false, false
+		}
+		v.end, v.verb, v.arg = i, r, arg
+		arg++
+		verbs = append(verbs, v)
+	}
+	if !reordered && arg != nargs {
+		return nil, false, false
+	}
+	return verbs, reordered, true
+}
+
+// formatsMessage returns true when v formats an error as its message, like errors.Wrapf does: %v, %s and %w,
+// or %+v and %+w, whose details such as stack traces are still printed with the wrapped error.
+func (v formatVerb) formatsMessage() bool {
+	if v.sized {
+		return false
+	}
+	switch v.verb {
+	case 's':
+		return v.flags == ""
+	case 'v', 'w':
+		return v.flags == "" || v.flags == "+"
+	}
+	return false
+}
+
+// errorVerbs returns the verbs that format errors among args, which are the verbs of the errors and the %w verbs.
+func errorVerbs(p *Pass, verbs []formatVerb, args []dst.Expr) []formatVerb {
+	var errs []formatVerb
+	for _, v := range verbs {
+		if v.verb == 'w' || p.IsErr(args[v.arg]) {
+			errs = append(errs, v)
+		}
+	}
+	return errs
+}
+
+// quoteFormat returns the literal of the format s, raw when lit is raw and s can be.
+func quoteFormat(lit *dst.BasicLit, s string) string {
+	if strings.HasPrefix(lit.Value, "`") && !strings.Contains(s, "`") {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
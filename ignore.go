@@ -0,0 +1,176 @@
+package errfix
+
+import (
+	"go/token"
+	"sort"
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// ignoreDirective is the prefix of the comments that suppress rewrites.
+// "//errfix:ignore" suppresses all rules, and "//errfix:ignore withstack,cause" only the listed ones.
+// Words after the list of rules, or after "--" when all rules are suppressed, are free text to give the reason.
+const ignoreDirective = "//errfix:ignore"
+
+// ruleIgnore is the rule name of the notes about errfix:ignore directives.
+const ruleIgnore = "ignore"
+
+// ignore is an errfix:ignore directive found in the decorations of a file, a declaration or a statement.
+// It applies to the node it decorates and all its descendants.
+type ignore struct {
+	pos   token.Position
+	rules []string
+	used  bool
+}
+
+func (ig *ignore) applies(rule string) bool {
+	if len(ig.rules) == 0 {
+		return true
+	}
+	for _, r := range ig.rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// findIgnores records the directives of the file, keyed by the node they decorate.
+func (ps *Pass) findIgnores(f *dst.File) {
+	ps.directives = map[dst.Node][]*ignore{}
+	dst.Inspect(f, func(n dst.Node) bool {
+		switch n.(type) {
+		case *dst.File, *dst.FuncDecl, *dst.GenDecl, dst.Stmt:
+		default:
+			return true
+		}
+		decs := n.Decorations()
+		for _, c := range append(decs.Start.All(), decs.End.All()...) {
+			if c != ignoreDirective && !strings.HasPrefix(c, ignoreDirective+" ") {
+				continue
+			}
+			ig := &ignore{pos: ps.Position(n)}
+			if fields := strings.Fields(strings.TrimPrefix(c, ignoreDirective)); len(fields) > 0 && fields[0] != "--" {
+				ig.rules = strings.Split(fields[0], ",")
+			}
+			ps.directives[n] = append(ps.directives[n], ig)
+		}
+		return true
+	})
+}
+
+// scopeIgnores maps every node of the file to the directives in effect for it.
+// It runs before every rule, so that the nodes created by the previous rules are covered as well.
+func (ps *Pass) scopeIgnores(f *dst.File) {
+	ps.ignores = map[dst.Node][]*ignore{}
+	if len(ps.directives) == 0 {
+		return
+	}
+	var active []*ignore
+	var stack [][]*ignore
+	dst.Inspect(f, func(n dst.Node) bool {
+		if n == nil {
+			active = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		stack = append(stack, active)
+		if igs, ok := ps.directives[n]; ok {
+			active = append(active[:len(active):len(active)], igs...)
+		}
+		if len(active) > 0 {
+			ps.ignores[n] = active
+		}
+		return true
+	})
+}
+
+// Ignored returns true when n is in the scope of an errfix:ignore directive that applies to the running rule,
+// outside of the changed lines when the rewrites are restricted to them, or accepted by the baseline.
+// Rules call it for a node they are about to rewrite, leave n unchanged when it returns true, and call Rewrote
+// once they have rewritten n. The call is taken as a rewrite that was about to be made: the directives that apply
+// are marked as used, and a rewrite accepted by the baseline uses up one of its occurrences. Calling it again for
+// the same node and rule returns the same answer without recording anything more.
+func (ps *Pass) Ignored(n dst.Node) bool {
+	k := ignoreCall{n, ps.rule}
+	if ignored, ok := ps.answered[k]; ok {
+		return ignored
+	}
+	ignored := ps.ignored(n)
+	ps.answered[k] = ignored
+	return ignored
+}
+
+// ignored computes the answer of Ignored for n.
+func (ps *Pass) ignored(n dst.Node) bool {
+	// The directives are marked as used even outside of the changed lines, where they would suppress the rewrite.
+	ignored := false
+	for _, ig := range ps.ignores[n] {
+		if ig.applies(ps.rule) {
+			ig.used = true
+			ignored = true
+		}
+	}
+	if ignored || ps.outsideChanges(n) {
+		return true
+	}
+	r := ps.newRewrite(n)
+	if ps.inBaseline(r.key) {
+		return true
+	}
+	ps.checked[n] = r
+	return false
+}
+
+// ignoreCall identifies the calls of Ignored for a node by a rule.
+type ignoreCall struct {
+	n    dst.Node
+	rule string
+}
+
+// Rewrote records that the running rule rewrote n, so that the edits of the file can be attributed to the rule
+// and the rewrite can be saved in a baseline. n is the node that was given to Ignored, even if it was replaced.
+func (ps *Pass) Rewrote(n dst.Node) {
+	r, ok := ps.checked[n]
+	if ok {
+		delete(ps.checked, n)
+	} else {
+		r = ps.newRewrite(n)
+	}
+	ps.rewrites = append(ps.rewrites, r)
+	if ps.baselineRecord != nil {
+		ps.baselineRecord.add(r.key)
+	}
+}
+
+// newRewrite returns the rewrite of n by the running rule, computed before n changes.
+func (ps *Pass) newRewrite(n dst.Node) rewrite {
+	r := rewrite{rule: ps.rule, pos: ps.Position(n), end: ps.endPosition(n)}
+	if ps.baseline != nil || ps.baselineRecord != nil {
+		r.key = ps.baselineKey(n)
+	}
+	return r
+}
+
+// noteUnusedIgnores reports the directives that suppressed nothing, so that they can be removed.
+func (ps *Pass) noteUnusedIgnores() {
+	var unused []*ignore
+	for _, igs := range ps.directives {
+		for _, ig := range igs {
+			if !ig.used {
+				unused = append(unused, ig)
+			}
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].pos.Offset < unused[j].pos.Offset
+	})
+	for _, ig := range unused {
+		directive := ignoreDirective
+		if len(ig.rules) > 0 {
+			directive += " " + strings.Join(ig.rules, ",")
+		}
+		ps.notes = append(ps.notes, Note{Pos: ig.pos, Rule: ruleIgnore, Message: directive + " suppresses nothing"})
+	}
+}
@@ -0,0 +1,174 @@
+package errfix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Report is the machine-readable result of errfix, as written by JSONWriter.
+type Report struct {
+	Findings []Finding `json:"findings"`
+	Summary  Summary   `json:"summary"`
+}
+
+// Finding is a rewrite of a rule.
+type Finding struct {
+	File        string   `json:"file"`
+	Start       Position `json:"start"`
+	End         Position `json:"end"`
+	Rule        string   `json:"rule"`
+	Message     string   `json:"message"`
+	Original    string   `json:"original"`
+	Replacement string   `json:"replacement"`
+	// Imports are the edits of the imports of the file that the replacement needs to compile, such as the import
+	// of github.com/pkg/errors. Findings of the same file may share them, and they are applied once.
+	Imports []Replacement `json:"imports,omitempty"`
+	// Written is true when the rewrite was written to the file.
+	Written bool `json:"written"`
+}
+
+// Replacement replaces a range of the original content of a file.
+type Replacement struct {
+	Start       Position `json:"start"`
+	End         Position `json:"end"`
+	Original    string   `json:"original"`
+	Replacement string   `json:"replacement"`
+}
+
+// Position is a position in the original content of a file. Line and column start at 1, and offset at 0.
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	Offset int `json:"offset"`
+}
+
+// Summary counts the findings of a report.
+type Summary struct {
+	// Files counts the files whose content changes.
+	Files    int `json:"files"`
+	Findings int `json:"findings"`
+	// Rules counts the rewrites by rule, which outnumber the findings when a finding holds several rewrites.
+	Rules map[string]int `json:"rules"`
+}
+
+// JSONWriter implements the Writer interface, and it collects the rewrites of the files as a Report.
+type JSONWriter struct {
+	writeThrough
+	findings []Finding
+	files    int
+	rules    map[string]int
+	changed  bool
+	notes    []Note
+	mu       sync.Mutex
+}
+
+// NewJSONWriter returns a JSONWriter whose Report holds a finding for every rewrite, with the positions and texts
+// that tools need to apply it, to be encoded by Encode.
+func NewJSONWriter(write bool) *JSONWriter {
+	return &JSONWriter{writeThrough: writeThrough{write}, rules: map[string]int{}}
+}
+
+// Write records a finding for every edit of a rule in the new file, and overwrites the old file when needed.
+// The edits that only follow from the others, such as the changes of imports, are not findings,
+// but they are listed with the findings that need them.
+func (w *JSONWriter) Write(ctx context.Context, f *File, f2 *File) error {
+	written, err := w.overwrite(f, f2)
+	if err != nil {
+		return err
+	}
+
+	var findings []Finding
+	fixes, _ := splitFixes(f.Content, f2.Content, f2.Edits)
+	for _, fix := range fixes {
+		e := fix[0]
+		finding := Finding{
+			File:        f.Name,
+			Start:       jsonPosition(e.Pos),
+			End:         jsonPosition(e.End),
+			Rule:        e.Rule,
+			Message:     e.Message,
+			Original:    e.OldText,
+			Replacement: e.NewText,
+			Written:     written,
+		}
+		for _, ie := range fix[1:] {
+			finding.Imports = append(finding.Imports, Replacement{
+				Start:       jsonPosition(ie.Pos),
+				End:         jsonPosition(ie.End),
+				Original:    ie.OldText,
+				Replacement: ie.NewText,
+			})
+		}
+		findings = append(findings, finding)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.findings = append(w.findings, findings...)
+	w.notes = append(w.notes, f2.Notes...)
+	if f.Content != f2.Content {
+		w.changed = true
+		w.files++
+		for rule, n := range f2.Rewrites {
+			w.rules[rule] += n
+		}
+	}
+	return nil
+}
+
+// jsonPosition returns the position of a report for pos.
+func jsonPosition(pos token.Position) Position {
+	return Position{Line: pos.Line, Column: pos.Column, Offset: pos.Offset}
+}
+
+// Report returns the findings of the files written so far, ordered by file and position.
+func (w *JSONWriter) Report() *Report {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := &Report{
+		Findings: append([]Finding{}, w.findings...),
+		Summary:  Summary{Files: w.files, Findings: len(w.findings), Rules: map[string]int{}},
+	}
+	sort.SliceStable(r.Findings, func(i, j int) bool {
+		a, b := r.Findings[i], r.Findings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Start.Offset < b.Start.Offset
+	})
+	for rule, n := range w.rules {
+		r.Summary.Rules[rule] = n
+	}
+	return r
+}
+
+// Changed returns true when the content of one of the files written so far changes,
+// even if only by edits that are not findings.
+func (w *JSONWriter) Changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.changed
+}
+
+// Notes returns the notes of the files written so far.
+func (w *JSONWriter) Notes() []Note {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Note(nil), w.notes...)
+}
+
+// Encode writes the report as indented JSON.
+func (w *JSONWriter) Encode(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(w.Report())
+	if err != nil {
+		return fmt.Errorf("error encoding report, %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package errfix
+
+import (
+	"context"
+	"go/token"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+// Names of the rules that modernize code written for errors.Cause, which stops at the first error
+// that does not implement causer, such as the errors wrapped with %w.
+const (
+	ruleCauseIs = "cause-is"
+	ruleCauseAs = "cause-as"
+)
+
+// ruleSetModernize is the name of the set of the rules that convert errors.Cause to errors.Is and errors.As.
+const ruleSetModernize = "modernize"
+
+func init() {
+	RegisterRule(newCauseIsRule)
+	RegisterRule(newCauseAsRule)
+}
+
+// ruleSets maps the names of rule sets, accepted wherever rule names are, to their rules in the order they run.
+var ruleSets = map[string][]string{
+	ruleSetModernize: {ruleCauseIs, ruleCauseAs},
+}
+
+// causeArg returns the argument of errors.Cause(err) when x is such a call of an error.
+func causeArg(p *Pass, x dst.Expr) (dst.Expr, bool) {
+	call, ok := x.(*dst.CallExpr)
+	if !ok || !isPkgSelector(call.Fun, "errors", "Cause") || len(call.Args) != 1 || !p.IsErr(call.Args[0]) {
+		return nil, false
+	}
+	return call.Args[0], true
+}
+
+type causeIsRule struct {
+	isRule
+}
+
+func newCauseIsRule() Rule {
+	return &causeIsRule{isRule: isRule{errorsIdent: "errors", isIdent: "Is", nilIdent: "nil", cause: true}}
+}
+
+func (r *causeIsRule) Name() string {
+	return ruleCauseIs
+}
+
+func (r *causeIsRule) Description() string {
+	return "compare errors with errors.Is instead of errors.Cause(err) == and switches on errors.Cause(err)"
+}
+
+func (r *causeIsRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	f, ok := n.(*dst.File)
+	if !ok {
+		return nil
+	}
+	// Comparisons are expressions of any kind of parent, so they are replaced with a cursor.
+	dstutil.Apply(f, nil, func(c *dstutil.Cursor) bool {
+		if n, ok := c.Node().(*dst.SwitchStmt); ok {
+			r.changed = r.fixSwitchStmt(p, n) || r.changed
+			return true
+		}
+		cond, ok := c.Node().(*dst.BinaryExpr)
+		if !ok || (cond.Op != token.EQL && cond.Op != token.NEQ) || isName(cond.Y, r.nilIdent) {
+			return true
+		}
+		// errors.Cause(err) == ErrX
+		// ->
+		// errors.Is(err, ErrX)
+		x, ok := causeArg(p, cond.X)
+		if !ok || p.Ignored(cond) {
+			return true
+		}
+		e := r.isExpr(&dst.BinaryExpr{X: x, Op: cond.Op, Y: cond.Y})
+		e.Decorations().Start, e.Decorations().End = cond.Decs.Start, cond.Decs.End
+		c.Replace(e)
+		p.Rewrote(cond)
+		r.changed = true
+		return true
+	})
+	return nil
+}
+
+type causeAsRule struct {
+	asRule
+	// twoValue holds the assertions in the two-value form that were left unchanged, such as ignored ones.
+	twoValue map[*dst.TypeAssertExpr]bool
+}
+
+func newCauseAsRule() Rule {
+	return &causeAsRule{asRule: asRule{errorsIdent: "errors", asIdent: "As", cause: true}, twoValue: map[*dst.TypeAssertExpr]bool{}}
+}
+
+func (r *causeAsRule) Name() string {
+	return ruleCauseAs
+}
+
+func (r *causeAsRule) Description() string {
+	return "assert error types with errors.As instead of errors.Cause(err).(T) and type switches on errors.Cause(err)"
+}
+
+func (r *causeAsRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	// The two-value assertions are rewritten with their statement, before their children are visited,
+	// so the assertions still found are in the single-value form, which panics instead of reporting a failure,
+	// unless their statement was left unchanged.
+	switch n := n.(type) {
+	case *dst.AssignStmt:
+		if len(n.Lhs) == 2 && len(n.Rhs) == 1 {
+			r.markTwoValue(n.Rhs[0])
+		}
+	case *dst.ValueSpec:
+		if len(n.Names) == 2 && len(n.Values) == 1 {
+			r.markTwoValue(n.Values[0])
+		}
+	case *dst.TypeAssertExpr:
+		if _, ok := causeArg(p, n.X); ok && n.Type != nil && !r.twoValue[n] {
+			p.Note(n, "type assertion left unchanged: only the two-value form can become errors.As")
+		}
+		return nil
+	}
+	return r.asRule.Process(ctx, p, n)
+}
+
+func (r *causeAsRule) markTwoValue(x dst.Expr) {
+	if assert, ok := x.(*dst.TypeAssertExpr); ok {
+		r.twoValue[assert] = true
+	}
+}
@@ -0,0 +1,99 @@
+package errfix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Packages is an input of NewReader that reads the go files of the packages matched by Go package patterns,
+// such as ./..., ./internal/... or github.com/org/repo/pkg, including their test files.
+// The patterns are resolved by the go command, as go build does: build constraints and GOFLAGS apply,
+// and vendor and testdata directories are left out.
+type Packages struct {
+	Patterns []string
+	// BuildFlags are passed to the go command, such as -tags=integration.
+	BuildFlags []string
+	// Dir is the directory to resolve the patterns from. It defaults to the working directory.
+	Dir string
+}
+
+// IsPattern returns true for the string inputs of NewReader that are package patterns instead of paths:
+// the patterns with ..., and the import paths that do not exist on disk. Names of go files, absolute paths and
+// paths starting with ./ or ../ are always paths, so that a mistyped directory is reported as missing.
+func IsPattern(s string) bool {
+	if strings.Contains(s, "...") {
+		return true
+	}
+	if strings.HasSuffix(s, ".go") {
+		return false
+	}
+	if _, err := os.Stat(s); err == nil {
+		return false
+	}
+	slashed := filepath.ToSlash(s)
+	return !filepath.IsAbs(s) && slashed != "." && slashed != ".." &&
+		!strings.HasPrefix(slashed, "./") && !strings.HasPrefix(slashed, "../") && !strings.HasPrefix(slashed, "/")
+}
+
+// packageError is the failure to load a package matched by the patterns.
+type packageError struct {
+	pkg string
+	err error
+}
+
+// files returns the go files of the packages, relative to the working directory when they are below it,
+// and the packages that cannot be loaded, so that the files of the others can still be processed.
+func (p Packages) files(ctx context.Context) ([]string, []packageError, error) {
+	cfg := &packages.Config{
+		Context:    ctx,
+		Mode:       packages.NeedName | packages.NeedFiles,
+		Tests:      true,
+		BuildFlags: p.BuildFlags,
+		Dir:        p.Dir,
+	}
+	pkgs, err := packages.Load(cfg, p.Patterns...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading packages %s, %v", strings.Join(p.Patterns, " "), err)
+	}
+
+	wd, _ := os.Getwd()
+	seen := map[string]bool{}
+	failed := map[string]bool{}
+	var files []string
+	var failures []packageError
+	for _, pkg := range pkgs {
+		if len(pkg.Errors) > 0 && len(pkg.GoFiles) == 0 {
+			// The package is listed again with its tests.
+			if name := pkg.PkgPath; !failed[name] {
+				failed[name] = true
+				failures = append(failures, packageError{name, fmt.Errorf("error loading package %s, %v", name, pkg.Errors[0])})
+			}
+			continue
+		}
+		// The main package generated for tests lives in the build cache.
+		if strings.HasSuffix(pkg.ID, ".test") {
+			continue
+		}
+		for _, name := range pkg.GoFiles {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if rel, err := filepath.Rel(wd, name); err == nil && wd != "" && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				name = rel
+			}
+			files = append(files, name)
+		}
+	}
+	if len(files) == 0 && len(failures) == 0 {
+		return nil, nil, fmt.Errorf("no go files matched %s", strings.Join(p.Patterns, " "))
+	}
+	sort.Strings(files)
+	return files, failures, nil
+}
@@ -0,0 +1,237 @@
+package errfix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// PatchFileName is the name of the combined patch written by PatchWriter.WriteDir.
+const PatchFileName = "errfix.patch"
+
+// PatchWriter implements the Writer interface, and it generates patches that git apply and patch -p1 accept.
+// The paths of the patches are relative to the root of the git repository of the files,
+// or of their Go module outside of a repository.
+type PatchWriter struct {
+	writeThrough
+	patches []filePatch
+	roots   map[string]string
+	notes   []Note
+	mu      sync.Mutex
+}
+
+type filePatch struct {
+	// path is the slash-separated path of the file relative to its root.
+	path string
+	text string
+}
+
+// NewPatchWriter returns a PatchWriter that holds the patches of the files until Patch or WriteDir is called,
+// to review the rewrites and apply them in a separate step.
+func NewPatchWriter(write bool) *PatchWriter {
+	return &PatchWriter{writeThrough: writeThrough{write}, roots: map[string]string{}}
+}
+
+// Write generates the patch of the old file, and overwrites the old file when needed.
+func (w *PatchWriter) Write(ctx context.Context, f *File, f2 *File) error {
+	if f.Content == f2.Content {
+		w.mu.Lock()
+		w.notes = append(w.notes, f2.Notes...)
+		w.mu.Unlock()
+		return nil
+	}
+
+	p := filepath.ToSlash(w.relPath(f.Name))
+	diff := difflib.UnifiedDiff{
+		A:        patchLines(f.Content),
+		B:        patchLines(f2.Content),
+		FromFile: "a/" + p,
+		ToFile:   "b/" + p,
+		Context:  3,
+	}
+	text, err := difflib.GetUnifiedDiffString(diff)
+	if err != nil {
+		return fmt.Errorf("error while generating diff, %v", err)
+	}
+	text = fmt.Sprintf("diff --git a/%s b/%s\n%s", p, p, text)
+
+	w.mu.Lock()
+	w.patches = append(w.patches, filePatch{path: p, text: text})
+	w.notes = append(w.notes, f2.Notes...)
+	w.mu.Unlock()
+
+	_, err = w.overwrite(f, f2)
+	return err
+}
+
+// noNewlineMarker follows the last line of a file that does not end with a newline in a patch.
+const noNewlineMarker = "\\ No newline at end of file\n"
+
+// patchLines splits s into the lines of a patch. Unlike difflib.SplitLines, it adds no empty line at the end,
+// which git apply would reject. A last line without a newline gets one, followed by noNewlineMarker,
+// so that it is not joined with the next line of the patch and differs from the same line with a newline.
+func patchLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := splitLines(s)
+	if last := lines[len(lines)-1]; !strings.HasSuffix(last, "\n") {
+		lines[len(lines)-1] = last + "\n" + noNewlineMarker
+	}
+	return lines
+}
+
+// relPath returns the path of the file name relative to its root,
+// or name itself for files that are not on disk such as stdin.
+func (w *PatchWriter) relPath(name string) string {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return name
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return name
+	}
+	dir := filepath.Dir(abs)
+	w.mu.Lock()
+	root, ok := w.roots[dir]
+	if !ok {
+		root = findRoot(dir)
+		w.roots[dir] = root
+	}
+	w.mu.Unlock()
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return name
+	}
+	return rel
+}
+
+// findRoot returns the closest directory of dir and its parents that holds .git, or go.mod otherwise.
+// Without both, it returns the working directory.
+func findRoot(dir string) string {
+	module := ""
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil && module == "" {
+			module = d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+	if module != "" {
+		return module
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return dir
+	}
+	return wd
+}
+
+// Patch returns the combined patch of the files written so far, ordered by path.
+func (w *PatchWriter) Patch() string {
+	var b strings.Builder
+	for _, p := range w.sorted() {
+		b.WriteString(p.text)
+	}
+	return b.String()
+}
+
+func (w *PatchWriter) sorted() []filePatch {
+	w.mu.Lock()
+	patches := append([]filePatch(nil), w.patches...)
+	w.mu.Unlock()
+	sort.SliceStable(patches, func(i, j int) bool {
+		return patches[i].path < patches[j].path
+	})
+	return patches
+}
+
+// Notes returns the notes of the files written so far.
+func (w *PatchWriter) Notes() []Note {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Note(nil), w.notes...)
+}
+
+// WriteDir writes the patches of the files written so far into the directory dir, which is created when needed,
+// and returns the names of the written files. Without perPackage, it writes a single PatchFileName.
+// With perPackage, it writes a patch per directory, named after the path of the directory as by patchName,
+// such as pkg_store.patch.
+func (w *PatchWriter) WriteDir(dir string, perPackage bool) ([]string, error) {
+	patches := w.sorted()
+	if len(patches) == 0 {
+		return nil, nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating patch directory, %v", err)
+	}
+
+	var names []string
+	contents := map[string]*strings.Builder{}
+	// dirs holds the directory of the files of every patch, so that two directories never share a patch.
+	dirs := map[string]string{}
+	for _, p := range patches {
+		name := PatchFileName
+		if perPackage {
+			name = patchName(p.path)
+			d := path.Dir(p.path)
+			if other, ok := dirs[name]; ok && other != d {
+				return nil, fmt.Errorf("error writing patch, the patches of %s and %s are both named %s", other, d, name)
+			}
+			dirs[name] = d
+		}
+		b, ok := contents[name]
+		if !ok {
+			b = &strings.Builder{}
+			contents[name] = b
+			names = append(names, name)
+		}
+		b.WriteString(p.text)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = filepath.Join(dir, name)
+		err := os.WriteFile(names[i], []byte(contents[name].String()), 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error writing patch, %v", err)
+		}
+	}
+	return names, nil
+}
+
+// patchName returns the name of the patch of the directory of the slash-separated path p.
+// The separators of the directory become _, while _, % and the bytes that are not valid in file names
+// are escaped as %XX, so that distinct directories get distinct names, such as pkg_store.patch for pkg/store
+// and pkg%5Fstore.patch for pkg_store. The root directory gets root.patch.
+func patchName(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return "root.patch"
+	}
+	var b strings.Builder
+	for i := 0; i < len(dir); i++ {
+		switch c := dir[i]; {
+		case c == '/':
+			b.WriteByte('_')
+		case c == '_' || c == '%' || c < ' ' || strings.IndexByte(`\:*?"<>|`, c) >= 0:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String() + ".patch"
+}
@@ -0,0 +1,489 @@
+package errfix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+	"gopkg.in/yaml.v3"
+)
+
+// PatternRule is a rewrite rule written as a pattern and a replacement, like the rules of gofmt -r.
+// In both expressions, $name is a wildcard that matches any expression,
+// and $name... matches any number of arguments of a call.
+// A wildcard used more than once in the pattern must match equal expressions.
+type PatternRule struct {
+	// Name is the name of the rule, as reported in notes.
+	Name string `yaml:"name"`
+	// Description describes the rule. It defaults to the pattern and the replacement.
+	Description string `yaml:"description"`
+	// Pattern is the expression to look for, such as fmt.Errorf($fmt, $args..., $err).
+	Pattern string `yaml:"pattern"`
+	// Replace is the expression that replaces the matches, such as errors.Wrapf($err, $fmt, $args...).
+	Replace string `yaml:"replace"`
+	// Where restricts what wildcards match: "error" for errors, "sentinel" for sentinel errors
+	// and "string" for string literals. The keys are wildcards, with or without the leading $.
+	Where map[string]string `yaml:"where"`
+	// Import is the path of the package the replacement refers to, if any.
+	// It is added to the files that the rule changes.
+	Import string `yaml:"import"`
+}
+
+type patternFile struct {
+	Rules []PatternRule `yaml:"rules"`
+}
+
+// LoadPatternRules reads pattern rules from a file.
+// Files ending with .yaml or .yml hold a list of rules under the key rules.
+// Other files, such as .errfix files, hold one rule per line:
+//
+//	# Comments start with #. Imports apply to the rules that follow them.
+//	import github.com/pkg/errors
+//	wrapf: fmt.Errorf($fmt, $args..., $err) -> errors.Wrapf($err, $fmt, $args...) where $err error, $fmt string
+func LoadPatternRules(name string) ([]PatternRule, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules, %v", err)
+	}
+
+	var rules []PatternRule
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		pf := &patternFile{}
+		err = yaml.Unmarshal(data, pf)
+		rules = pf.Rules
+	default:
+		rules, err = parsePatternLines(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing rules %s, %v", name, err)
+	}
+	return rules, nil
+}
+
+var patternLineRegexp = regexp.MustCompile(`^([\w-]+):\s*(.+?)\s*->\s*(.+?)(?:\s+where\s+(.+))?$`)
+
+func parsePatternLines(data []byte) ([]PatternRule, error) {
+	var rules []PatternRule
+	imp := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "import ") {
+			imp = strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "import ")), `"`)
+			continue
+		}
+		m := patternLineRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: expected name: pattern -> replacement", i)
+		}
+		r := PatternRule{Name: m[1], Pattern: m[2], Replace: m[3], Import: imp}
+		if m[4] != "" {
+			r.Where = map[string]string{}
+			for _, cond := range strings.Split(m[4], ",") {
+				fields := strings.Fields(cond)
+				if len(fields) != 2 {
+					return nil, fmt.Errorf("line %d: expected where $name kind", i)
+				}
+				r.Where[fields[0]] = fields[1]
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// Compile parses the pattern and the replacement of the rule.
+func (r PatternRule) Compile() (NewRuleFunc, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("rule %q has no name", r.Pattern)
+	}
+	pattern, err := parsePatternExpr(r.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern of rule %s, %v", r.Name, err)
+	}
+	replace, err := parsePatternExpr(r.Replace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replacement of rule %s, %v", r.Name, err)
+	}
+	names := wildcardNames(pattern)
+	for name := range wildcardNames(replace) {
+		if !names[name] {
+			return nil, fmt.Errorf("wildcard $%s of rule %s is not in the pattern", name, r.Name)
+		}
+	}
+	where := map[string]string{}
+	for name, kind := range r.Where {
+		name = strings.TrimPrefix(name, "$")
+		if !names[name] {
+			return nil, fmt.Errorf("wildcard $%s of rule %s is not in the pattern", name, r.Name)
+		}
+		if _, ok := wildcardKinds[kind]; !ok {
+			return nil, fmt.Errorf("unknown kind %q of $%s in rule %s", kind, name, r.Name)
+		}
+		where[name] = kind
+	}
+	description := r.Description
+	if description == "" {
+		description = r.Pattern + " -> " + r.Replace
+	}
+
+	c := &compiledPattern{
+		name:        r.Name,
+		description: description,
+		pattern:     pattern,
+		replace:     replace,
+		where:       where,
+		importPath:  r.Import,
+	}
+	return func() Rule { return &patternRule{compiledPattern: c} }, nil
+}
+
+// CompilePatternRules compiles all rules, as expected by WithRules.
+func CompilePatternRules(rules []PatternRule) ([]NewRuleFunc, error) {
+	var newRules []NewRuleFunc
+	names := map[string]bool{}
+	for _, r := range rules {
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule %s", r.Name)
+		}
+		names[r.Name] = true
+		newRule, err := r.Compile()
+		if err != nil {
+			return nil, err
+		}
+		newRules = append(newRules, newRule)
+	}
+	return newRules, nil
+}
+
+// Wildcards are turned into identifiers that cannot appear in Go source files written by hand,
+// so that patterns can be parsed by go/parser.
+const (
+	wildcardPrefix     = "__errfix_"
+	listWildcardPrefix = "__errfix_list_"
+)
+
+var wildcardRegexp = regexp.MustCompile(`\$(\w+)(\.\.\.)?`)
+
+func parsePatternExpr(s string) (dst.Expr, error) {
+	src := wildcardRegexp.ReplaceAllStringFunc(s, func(w string) string {
+		m := wildcardRegexp.FindStringSubmatch(w)
+		if m[2] != "" {
+			return listWildcardPrefix + m[1]
+		}
+		return wildcardPrefix + m[1]
+	})
+	fset := token.NewFileSet()
+	ae, err := parser.ParseExprFrom(fset, "", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	n, err := decorator.NewDecorator(fset).DecorateNode(ae)
+	if err != nil {
+		return nil, err
+	}
+	return n.(dst.Expr), nil
+}
+
+// wildcard returns the name of the wildcard n stands for, and whether it matches a list of arguments.
+func wildcard(n dst.Node) (string, bool, bool) {
+	id, ok := n.(*dst.Ident)
+	if !ok {
+		return "", false, false
+	}
+	if strings.HasPrefix(id.Name, listWildcardPrefix) {
+		return strings.TrimPrefix(id.Name, listWildcardPrefix), true, true
+	}
+	if strings.HasPrefix(id.Name, wildcardPrefix) {
+		return strings.TrimPrefix(id.Name, wildcardPrefix), false, true
+	}
+	return "", false, false
+}
+
+// wildcardNames returns the names of the wildcards of e.
+func wildcardNames(e dst.Expr) map[string]bool {
+	names := map[string]bool{}
+	dst.Inspect(e, func(n dst.Node) bool {
+		if name, _, ok := wildcard(n); ok {
+			names[name] = true
+		}
+		return true
+	})
+	return names
+}
+
+// wildcardKinds are the restrictions that can be put on wildcards.
+var wildcardKinds = map[string]func(*Pass, dst.Node) bool{
+	"error": func(p *Pass, n dst.Node) bool {
+		e, ok := n.(dst.Expr)
+		return ok && p.IsErr(e)
+	},
+	"sentinel": func(p *Pass, n dst.Node) bool {
+		e, ok := n.(dst.Expr)
+		return ok && p.IsSentinel(e)
+	},
+	"string": func(p *Pass, n dst.Node) bool {
+		lit, ok := n.(*dst.BasicLit)
+		return ok && lit.Kind == token.STRING
+	},
+}
+
+type compiledPattern struct {
+	name        string
+	description string
+	pattern     dst.Expr
+	replace     dst.Expr
+	where       map[string]string
+	importPath  string
+}
+
+type patternRule struct {
+	*compiledPattern
+	changed bool
+}
+
+func (r *patternRule) Name() string {
+	return r.name
+}
+
+func (r *patternRule) Description() string {
+	return r.description
+}
+
+// Process does nothing, as replacing an expression needs its parent. The work is done by EndProcess.
+func (r *patternRule) Process(ctx context.Context, p *Pass, n dst.Node) error {
+	return nil
+}
+
+func (r *patternRule) EndProcess(ctx context.Context, p *Pass, f *dst.File) (bool, error) {
+	// Expressions are rewritten bottom-up, and replacements are not walked again.
+	dstutil.Apply(f, nil, func(c *dstutil.Cursor) bool {
+		e, ok := c.Node().(dst.Expr)
+		if !ok {
+			return true
+		}
+		m := &patternMatch{pass: p, where: r.where, binds: map[string]dst.Node{}, lists: map[string][]dst.Expr{}}
+		if !m.node(r.pattern, e) {
+			return true
+		}
+		e2 := m.substitute(r.replace)
+		if !canReplace(c, e2) || p.Ignored(e) {
+			return true
+		}
+		*e2.Decorations() = *e.Decorations()
+		c.Replace(e2)
+		p.Rewrote(e)
+		r.changed = true
+		return true
+	})
+	if !r.changed {
+		return false, nil
+	}
+
+	switch r.importPath {
+	case "":
+	case pkgErrorsPath:
+		usePkgErrors(f)
+	case "errors":
+		useStdErrors(f)
+	default:
+		imports := getImports(f)
+		if findImportByPath(imports, r.importPath) == nil {
+			addImport(f, r.importPath, "", imports)
+		}
+	}
+	return true, nil
+}
+
+// canReplace returns true when the field holding the node under the cursor accepts n.
+func canReplace(c *dstutil.Cursor, n dst.Node) bool {
+	field := reflect.Indirect(reflect.ValueOf(c.Parent())).FieldByName(c.Name())
+	if !field.IsValid() {
+		return false
+	}
+	t := field.Type()
+	if c.Index() >= 0 {
+		t = t.Elem()
+	}
+	return reflect.TypeOf(n).AssignableTo(t)
+}
+
+var (
+	objectType = reflect.TypeOf((*dst.Object)(nil))
+	scopeType  = reflect.TypeOf((*dst.Scope)(nil))
+	exprsType  = reflect.TypeOf([]dst.Expr(nil))
+)
+
+// patternMatch matches a pattern against a node and records what the wildcards matched.
+type patternMatch struct {
+	pass  *Pass
+	where map[string]string
+	binds map[string]dst.Node
+	lists map[string][]dst.Expr
+	used  map[string]bool
+}
+
+func (m *patternMatch) node(pattern, n dst.Node) bool {
+	return m.value(reflect.ValueOf(pattern), reflect.ValueOf(n))
+}
+
+func (m *patternMatch) bind(name string, n dst.Node) bool {
+	if kind, ok := m.where[name]; ok && !wildcardKinds[kind](m.pass, n) {
+		return false
+	}
+	if prev, ok := m.binds[name]; ok {
+		// The bound node has no wildcards, so matching it checks that both are equal.
+		return (&patternMatch{}).node(prev, n)
+	}
+	m.binds[name] = n
+	return true
+}
+
+// value compares the fields of nodes recursively, ignoring decorations and objects.
+func (m *patternMatch) value(p, v reflect.Value) bool {
+	if p.IsValid() && (p.Kind() == reflect.Interface || p.Kind() == reflect.Ptr) && !p.IsNil() {
+		if pn, ok := p.Interface().(dst.Node); ok {
+			if name, isList, ok := wildcard(pn); ok && !isList {
+				if !v.IsValid() || ((v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) && v.IsNil()) {
+					return false
+				}
+				n, ok := v.Interface().(dst.Node)
+				return ok && m.bind(name, n)
+			}
+		}
+	}
+	if !p.IsValid() || !v.IsValid() {
+		return p.IsValid() == v.IsValid()
+	}
+	if p.Type() != v.Type() {
+		return false
+	}
+	switch p.Kind() {
+	case reflect.Interface:
+		if p.IsNil() || v.IsNil() {
+			return p.IsNil() && v.IsNil()
+		}
+		return m.value(p.Elem(), v.Elem())
+	case reflect.Ptr:
+		if p.Type() == objectType || p.Type() == scopeType {
+			return true
+		}
+		if p.IsNil() || v.IsNil() {
+			return p.IsNil() && v.IsNil()
+		}
+		return m.value(p.Elem(), v.Elem())
+	case reflect.Struct:
+		for i := 0; i < p.NumField(); i++ {
+			f := p.Type().Field(i)
+			if f.Name == "Decs" || f.PkgPath != "" {
+				continue
+			}
+			if !m.value(p.Field(i), v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		if p.Type() == exprsType {
+			return m.exprs(p.Interface().([]dst.Expr), v.Interface().([]dst.Expr))
+		}
+		if p.Len() != v.Len() {
+			return false
+		}
+		for i := 0; i < p.Len(); i++ {
+			if !m.value(p.Index(i), v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return p.Interface() == v.Interface()
+	}
+}
+
+// exprs matches a list of expressions, in which one wildcard may match any number of expressions.
+func (m *patternMatch) exprs(ps, vs []dst.Expr) bool {
+	for i, pe := range ps {
+		name, isList, ok := wildcard(pe)
+		if !ok || !isList {
+			continue
+		}
+		rest := len(ps) - i - 1
+		if len(vs) < i+rest {
+			return false
+		}
+		for j := 0; j < i; j++ {
+			if !m.node(ps[j], vs[j]) {
+				return false
+			}
+		}
+		for j := 0; j < rest; j++ {
+			if !m.node(ps[i+1+j], vs[len(vs)-rest+j]) {
+				return false
+			}
+		}
+		m.lists[name] = vs[i : len(vs)-rest]
+		return true
+	}
+	if len(ps) != len(vs) {
+		return false
+	}
+	for i := range ps {
+		if !m.node(ps[i], vs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// substitute returns a copy of the replacement with the wildcards replaced by what they matched.
+// The matched nodes are moved at their first use and copied at the next ones,
+// so that type information about them is kept.
+func (m *patternMatch) substitute(replace dst.Expr) dst.Expr {
+	m.used = map[string]bool{}
+	e := dst.Clone(replace)
+	return dstutil.Apply(e, nil, func(c *dstutil.Cursor) bool {
+		name, isList, ok := wildcard(c.Node())
+		if !ok {
+			return true
+		}
+		if !isList {
+			if n, ok := m.binds[name]; ok && canReplace(c, n) {
+				c.Replace(m.use(name, n))
+			}
+			return true
+		}
+		if c.Index() < 0 {
+			return true
+		}
+		for _, n := range m.lists[name] {
+			c.InsertBefore(m.use(name, n))
+		}
+		c.Delete()
+		return true
+	}).(dst.Expr)
+}
+
+func (m *patternMatch) use(name string, n dst.Node) dst.Node {
+	key := fmt.Sprintf("%s#%p", name, n)
+	if m.used[key] {
+		return dst.Clone(n)
+	}
+	m.used[key] = true
+	return n
+}
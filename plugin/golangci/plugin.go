@@ -0,0 +1,26 @@
+// Package main is a golangci-lint plugin of errfix, built with go build -buildmode=plugin.
+package main
+
+import (
+	"golang.org/x/tools/go/analysis"
+
+	"github.com/yaoguais/errfix"
+)
+
+// New returns the analyzers of the plugin, as looked up by golangci-lint.
+func New(conf any) ([]*analysis.Analyzer, error) {
+	return []*analysis.Analyzer{errfix.Analyzer}, nil
+}
+
+type analyzerPlugin struct{}
+
+// GetAnalyzers returns the analyzers of the plugin, for the versions of golangci-lint that look up AnalyzerPlugin.
+func (analyzerPlugin) GetAnalyzers() []*analysis.Analyzer {
+	return []*analysis.Analyzer{errfix.Analyzer}
+}
+
+// AnalyzerPlugin is looked up by older versions of golangci-lint.
+var AnalyzerPlugin analyzerPlugin
+
+// main is required by go build, and unused by plugins.
+func main() {}
@@ -0,0 +1,174 @@
+package errfix
+
+import (
+	"context"
+	"fmt"
+	"go/token"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// Rule rewrites the decorated syntax tree of a file.
+// The built-in rules implement it as well, so custom rules run in the same pipeline.
+type Rule interface {
+	// Name returns the name of the rule, as used in notes and to look the rule up in the registry.
+	Name() string
+	// Description returns a one-line description of what the rule rewrites.
+	Description() string
+	// Process is called for every node of the file in depth-first order, as in dst.Inspect,
+	// including a nil node after the children of every node.
+	Process(context.Context, *Pass, dst.Node) error
+	// EndProcess is called once all nodes have been processed, to add imports for example.
+	// It returns true when the rule changed the file.
+	EndProcess(context.Context, *Pass, *dst.File) (bool, error)
+}
+
+// NewRuleFunc returns a new instance of a rule.
+// It is called for every file, so a rule can keep the state of one file in its fields.
+type NewRuleFunc func() Rule
+
+var registry = struct {
+	sync.Mutex
+	rules map[string]NewRuleFunc
+}{rules: map[string]NewRuleFunc{}}
+
+// RegisterRule makes a rule available by its name. It is meant to be called from init functions.
+// It panics when a rule with the same name is already registered.
+func RegisterRule(newRule NewRuleFunc) {
+	name := newRule().Name()
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.rules[name]; ok {
+		panic(fmt.Sprintf("errfix: rule %s is already registered", name))
+	}
+	registry.rules[name] = newRule
+}
+
+// LookupRule returns the rule registered with the given name.
+func LookupRule(name string) (NewRuleFunc, error) {
+	registry.Lock()
+	defer registry.Unlock()
+	newRule, ok := registry.rules[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rule %q", name)
+	}
+	return newRule, nil
+}
+
+// RegisteredRules returns the names of the registered rules in alphabetical order.
+func RegisteredRules() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	names := make([]string, 0, len(registry.rules))
+	for name := range registry.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pass holds the state of a single file shared by the rules.
+type Pass struct {
+	file         *dst.File
+	dec          *decorator.Decorator
+	isErr        errMatcher
+	topLevel     map[dst.Node]bool
+	sentinels    map[string]bool
+	stdSentinels bool
+	messageStyle MessageStyle
+	stdNews      []*dst.SelectorExpr
+	notes        []Note
+	rule         string
+	directives   map[dst.Node][]*ignore
+	ignores      map[dst.Node][]*ignore
+	rewrites     []rewrite
+	// checked holds the rewrites of the nodes that Ignored let through, computed while the nodes are unchanged.
+	checked map[dst.Node]rewrite
+	// answered holds the answers of Ignored.
+	answered    map[ignoreCall]bool
+	changesOnly bool
+	changed     []LineRange
+	// fileName is the absolute path of the file, and content its original content.
+	fileName       string
+	content        string
+	baseline       *Baseline
+	baselineRecord *Baseline
+	baselineUsed   map[baselineKey]int
+	// imports holds the names of the packages imported by the original file, by path.
+	imports map[string]string
+}
+
+// rewrite records that a rule rewrote the code of a node of the original file, which spans the lines from pos to end.
+type rewrite struct {
+	rule     string
+	pos, end token.Position
+	// key identifies the rewrite in baselines, when one is used.
+	key baselineKey
+}
+
+// IsErr returns true when the expression is an error value that the rules should rewrite,
+// either by the name of the identifier or by its type when type checking is enabled.
+func (ps *Pass) IsErr(n dst.Expr) bool {
+	return ps.isErr(n)
+}
+
+// IsSentinel returns true when the expression names a sentinel error that must stay unwrapped by contract.
+func (ps *Pass) IsSentinel(n dst.Expr) bool {
+	return ps.sentinels[exprString(n)]
+}
+
+// IsTopLevel returns true when n is part of a package-level declaration, outside of function literals.
+func (ps *Pass) IsTopLevel(n dst.Node) bool {
+	return ps.topLevel[n]
+}
+
+// Position returns the position of n in the original file.
+// Nodes created by the rules have no position.
+func (ps *Pass) Position(n dst.Node) token.Position {
+	an, ok := ps.dec.Ast.Nodes[n]
+	if !ok {
+		return token.Position{}
+	}
+	return ps.dec.Fset.Position(an.Pos())
+}
+
+// endPosition returns the position of the end of n in the original file, like Position.
+func (ps *Pass) endPosition(n dst.Node) token.Position {
+	an, ok := ps.dec.Ast.Nodes[n]
+	if !ok {
+		return token.Position{}
+	}
+	return ps.dec.Fset.Position(an.End())
+}
+
+// Note records that the running rule left n unchanged on purpose.
+func (ps *Pass) Note(n dst.Node, msg string) {
+	if ps.outsideChanges(n) {
+		return
+	}
+	ps.notes = append(ps.notes, Note{Pos: ps.Position(n), Rule: ps.rule, Message: msg})
+}
+
+// styleMessage applies the message style to the message or format of an error.
+func (ps *Pass) styleMessage(s string) string {
+	if ps.messageStyle != MessageStyleLower {
+		return s
+	}
+	s = strings.TrimRight(s, ".!")
+	first := s
+	if i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) }); i >= 0 {
+		first = s[:i]
+	}
+	r, size := utf8.DecodeRuneInString(first)
+	// Acronyms such as EOF or JSON are kept.
+	if first == "" || first == "I" || strings.IndexFunc(first[size:], unicode.IsUpper) >= 0 {
+		return s
+	}
+	return string(unicode.ToLower(r)) + s[size:]
+}
@@ -0,0 +1,265 @@
+package errfix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// SARIF is a log of the SARIF 2.1.0 format, as written by SARIFWriter.
+// Only the properties used by errfix are defined.
+type SARIF struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []SARIFRun `json:"runs"`
+}
+
+// SARIFRun is a run of errfix.
+type SARIFRun struct {
+	Tool       SARIFTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []SARIFResult `json:"results"`
+}
+
+// SARIFTool describes errfix and its rules.
+type SARIFTool struct {
+	Driver SARIFDriver `json:"driver"`
+}
+
+// SARIFDriver describes errfix and its rules.
+type SARIFDriver struct {
+	Name           string                     `json:"name"`
+	InformationURI string                     `json:"informationUri"`
+	Rules          []SARIFReportingDescriptor `json:"rules"`
+}
+
+// SARIFReportingDescriptor describes a rule.
+type SARIFReportingDescriptor struct {
+	ID               string       `json:"id"`
+	ShortDescription SARIFMessage `json:"shortDescription"`
+}
+
+// SARIFMessage is a plain text message.
+type SARIFMessage struct {
+	Text string `json:"text"`
+}
+
+// SARIFResult is a rewrite of a rule, with the fix that applies it.
+type SARIFResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   SARIFMessage    `json:"message"`
+	Locations []SARIFLocation `json:"locations"`
+	Fixes     []SARIFFix      `json:"fixes"`
+}
+
+// SARIFLocation is the location of a result.
+type SARIFLocation struct {
+	PhysicalLocation SARIFPhysicalLocation `json:"physicalLocation"`
+}
+
+// SARIFPhysicalLocation is a region of a file.
+type SARIFPhysicalLocation struct {
+	ArtifactLocation SARIFArtifactLocation `json:"artifactLocation"`
+	Region           SARIFRegion           `json:"region"`
+}
+
+// SARIFArtifactLocation is the location of a file.
+type SARIFArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+// SARIFRegion is a range of a file. Columns count Unicode code points and start at 1.
+type SARIFRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+// SARIFFix is the change proposed by a result.
+type SARIFFix struct {
+	Description     SARIFMessage          `json:"description"`
+	ArtifactChanges []SARIFArtifactChange `json:"artifactChanges"`
+}
+
+// SARIFArtifactChange is the change of a file.
+type SARIFArtifactChange struct {
+	ArtifactLocation SARIFArtifactLocation `json:"artifactLocation"`
+	Replacements     []SARIFReplacement    `json:"replacements"`
+}
+
+// SARIFReplacement replaces a region of a file.
+type SARIFReplacement struct {
+	DeletedRegion   SARIFRegion  `json:"deletedRegion"`
+	InsertedContent SARIFMessage `json:"insertedContent"`
+}
+
+// SARIFWriter implements the Writer interface, and it collects the rewrites of the files as a SARIF log.
+type SARIFWriter struct {
+	writeThrough
+	results []SARIFResult
+	notes   []Note
+	mu      sync.Mutex
+}
+
+// NewSARIFWriter returns a SARIFWriter whose Log holds a SARIF 2.1.0 run, with a result and a fix for every rewrite,
+// for code-scanning dashboards.
+func NewSARIFWriter(write bool) *SARIFWriter {
+	return &SARIFWriter{writeThrough: writeThrough{write}}
+}
+
+// Write records a result for every edit of a rule in the new file, and overwrites the old file when needed.
+// The edits that only follow from the others, such as the changes of imports, are not results,
+// but replacements of the fixes of the results that need them, so that every fix gives code that compiles.
+func (w *SARIFWriter) Write(ctx context.Context, f *File, f2 *File) error {
+	if _, err := w.overwrite(f, f2); err != nil {
+		return err
+	}
+
+	uri := sarifURI(f.Name)
+	location := SARIFArtifactLocation{URI: uri}
+	region := func(e Edit) SARIFRegion {
+		return SARIFRegion{
+			StartLine:   e.Pos.Line,
+			StartColumn: runeColumn(f.Content, e.Pos.Offset, e.Pos.Column),
+			EndLine:     e.End.Line,
+			EndColumn:   runeColumn(f.Content, e.End.Offset, e.End.Column),
+		}
+	}
+	fixes, _ := splitFixes(f.Content, f2.Content, f2.Edits)
+	var results []SARIFResult
+	for _, fix := range fixes {
+		e := fix[0]
+		var replacements []SARIFReplacement
+		for _, fe := range fix {
+			replacements = append(replacements, SARIFReplacement{DeletedRegion: region(fe), InsertedContent: SARIFMessage{Text: fe.NewText}})
+		}
+		sort.SliceStable(replacements, func(i, j int) bool {
+			a, b := replacements[i].DeletedRegion, replacements[j].DeletedRegion
+			if a.StartLine != b.StartLine {
+				return a.StartLine < b.StartLine
+			}
+			return a.StartColumn < b.StartColumn
+		})
+		results = append(results, SARIFResult{
+			RuleID:    e.Rule,
+			Level:     "warning",
+			Message:   SARIFMessage{Text: e.Message},
+			Locations: []SARIFLocation{{PhysicalLocation: SARIFPhysicalLocation{ArtifactLocation: location, Region: region(e)}}},
+			Fixes: []SARIFFix{{
+				Description: SARIFMessage{Text: e.Message},
+				ArtifactChanges: []SARIFArtifactChange{{
+					ArtifactLocation: location,
+					Replacements:     replacements,
+				}},
+			}},
+		})
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.results = append(w.results, results...)
+	w.notes = append(w.notes, f2.Notes...)
+	return nil
+}
+
+// Log returns the SARIF log of the files written so far, with the results ordered by file and position.
+// The rules of the log are the registered rules, and the other rules that have results, such as pattern rules.
+func (w *SARIFWriter) Log() *SARIF {
+	w.mu.Lock()
+	results := append([]SARIFResult{}, w.results...)
+	w.mu.Unlock()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i].Locations[0].PhysicalLocation, results[j].Locations[0].PhysicalLocation
+		if a.ArtifactLocation.URI != b.ArtifactLocation.URI {
+			return a.ArtifactLocation.URI < b.ArtifactLocation.URI
+		}
+		if a.Region.StartLine != b.Region.StartLine {
+			return a.Region.StartLine < b.Region.StartLine
+		}
+		return a.Region.StartColumn < b.Region.StartColumn
+	})
+
+	var rules []SARIFReportingDescriptor
+	index := map[string]int{}
+	for _, name := range RegisteredRules() {
+		newRule, _ := LookupRule(name)
+		index[name] = len(rules)
+		rules = append(rules, SARIFReportingDescriptor{ID: name, ShortDescription: SARIFMessage{Text: newRule().Description()}})
+	}
+	var others []SARIFReportingDescriptor
+	for _, r := range results {
+		if _, ok := index[r.RuleID]; !ok {
+			index[r.RuleID] = -1
+			others = append(others, SARIFReportingDescriptor{ID: r.RuleID, ShortDescription: r.Message})
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].ID < others[j].ID
+	})
+	for _, d := range others {
+		index[d.ID] = len(rules)
+		rules = append(rules, d)
+	}
+	for i := range results {
+		results[i].RuleIndex = index[results[i].RuleID]
+	}
+
+	return &SARIF{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []SARIFRun{{
+			Tool: SARIFTool{Driver: SARIFDriver{
+				Name:           "errfix",
+				InformationURI: "https://github.com/yaoguais/errfix",
+				Rules:          rules,
+			}},
+			ColumnKind: "unicodeCodePoints",
+			Results:    results,
+		}},
+	}
+}
+
+// Notes returns the notes of the files written so far.
+func (w *SARIFWriter) Notes() []Note {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Note(nil), w.notes...)
+}
+
+// Encode writes the SARIF log as indented JSON.
+func (w *SARIFWriter) Encode(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(w.Log())
+	if err != nil {
+		return fmt.Errorf("error encoding sarif log, %v", err)
+	}
+	return nil
+}
+
+// sarifURI returns the URI of a file, relative for relative names.
+func sarifURI(name string) string {
+	uri := filepath.ToSlash(name)
+	if filepath.IsAbs(name) {
+		if uri[0] != '/' {
+			uri = "/" + uri
+		}
+		uri = "file://" + uri
+	}
+	return uri
+}
+
+// runeColumn converts the byte column of an offset of content to a column of code points.
+func runeColumn(content string, offset, column int) int {
+	start := offset - column + 1
+	return utf8.RuneCountInString(content[start:offset]) + 1
+}
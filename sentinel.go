@@ -0,0 +1,106 @@
+package errfix
+
+import (
+	"go/token"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// topLevelNodes returns the nodes of package-level declarations, leaving out function literals.
+// Expressions in these declarations are evaluated once at init time, usually to declare sentinel errors.
+func topLevelNodes(f *dst.File) map[dst.Node]bool {
+	nodes := map[dst.Node]bool{}
+	for _, decl := range f.Decls {
+		if _, ok := decl.(*dst.GenDecl); !ok {
+			continue
+		}
+		dst.Inspect(decl, func(n dst.Node) bool {
+			if _, ok := n.(*dst.FuncLit); ok || n == nil {
+				return false
+			}
+			nodes[n] = true
+			return true
+		})
+	}
+	return nodes
+}
+
+// stdSentinelNews returns the selectors of the calls of errors.New of the standard library in package-level
+// declarations, such as var ErrNotFound = errors.New("not found"), so that they stay so if the errors import is replaced.
+// Such sentinels are never converted to stack-capturing constructors, as the stack of init time is useless.
+func stdSentinelNews(f *dst.File, topLevel map[dst.Node]bool) []*dst.SelectorExpr {
+	imp := findImportByPath(getImports(f), "errors")
+	if imp == nil || importName(imp) != "errors" {
+		return nil
+	}
+	var sels []*dst.SelectorExpr
+	for n := range topLevel {
+		if call, ok := n.(*dst.CallExpr); ok && isPkgSelector(call.Fun, "errors", "New") {
+			sels = append(sels, call.Fun.(*dst.SelectorExpr))
+		}
+	}
+	return sels
+}
+
+// fixSentinelDecl handles a call in a package-level declaration, such as var ErrNotFound = fmt.Errorf("not found").
+// When stdSentinels is enabled, fmt.Errorf without arguments is rewritten to errors.New of the standard library.
+// It returns true when n was rewritten.
+func (ps *Pass) fixSentinelDecl(n *dst.CallExpr) bool {
+	if !ps.stdSentinels {
+		return false
+	}
+	if !isPkgSelector(n.Fun, "fmt", "Errorf") || len(n.Args) != 1 {
+		return false
+	}
+	lit, ok := n.Args[0].(*dst.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return false
+	}
+	format, err := strconv.Unquote(lit.Value)
+	if err != nil || strings.Contains(strings.ReplaceAll(format, "%%", ""), "%") || ps.Ignored(n) {
+		return false
+	}
+	// fmt.Errorf("not found") ->
+	// errors.New("not found")
+	if strings.Contains(format, "%%") {
+		lit.Value = strconv.Quote(strings.ReplaceAll(format, "%%", "%"))
+	}
+	sel := &dst.SelectorExpr{X: dst.NewIdent("errors"), Sel: dst.NewIdent("New")}
+	n.Fun = sel
+	ps.stdNews = append(ps.stdNews, sel)
+	ps.Rewrote(n)
+	return true
+}
+
+// fixStdErrorsSelectors makes the selectors refer to the errors package of the standard library.
+// The package is imported as stderrors when the name errors is taken by another package.
+func fixStdErrorsSelectors(f *dst.File, sels []*dst.SelectorExpr) {
+	if len(sels) == 0 {
+		return
+	}
+
+	name := "errors"
+	imports := getImports(f)
+	if imp := findImportByPath(imports, "errors"); imp != nil {
+		name = importName(imp)
+	} else {
+		for _, imp := range imports {
+			for _, spec := range imp.Specs {
+				if importName(spec.(*dst.ImportSpec)) == name {
+					name = "stderrors"
+				}
+			}
+		}
+		if name == "errors" {
+			addImport(f, "errors", "", imports)
+		} else {
+			addImport(f, "errors", name, imports)
+		}
+	}
+
+	for _, sel := range sels {
+		sel.X = dst.NewIdent(name)
+	}
+}
@@ -0,0 +1,134 @@
+package errfix
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// FileStat counts the rewrites of a file by rule.
+type FileStat struct {
+	Name string
+	// Changed is true when the new content of the file differs from the old one,
+	// which includes changes that follow from the rewrites, such as imports.
+	Changed bool
+	Rules   map[string]int
+}
+
+// Total returns the number of rewrites of the file.
+func (s FileStat) Total() int {
+	n := 0
+	for _, c := range s.Rules {
+		n += c
+	}
+	return n
+}
+
+// StatWriter implements the Writer interface, and it counts the rewrites of the files by rule,
+// to list the files that change or print a summary table.
+type StatWriter struct {
+	writeThrough
+	stats []FileStat
+	notes []Note
+	mu    sync.Mutex
+}
+
+// NewStatWriter returns a StatWriter whose Stats count the rewrites of every file by rule, as printed by Table,
+// and whose changed files are listed by List.
+func NewStatWriter(write bool) *StatWriter {
+	return &StatWriter{writeThrough: writeThrough{write}}
+}
+
+// Write counts the rewrites of the rules in the new file, and overwrites the old file when needed.
+func (w *StatWriter) Write(ctx context.Context, f *File, f2 *File) error {
+	s := FileStat{Name: f.Name, Changed: f.Content != f2.Content, Rules: map[string]int{}}
+	if _, err := w.overwrite(f, f2); err != nil {
+		return err
+	}
+	for rule, n := range f2.Rewrites {
+		s.Rules[rule] += n
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stats = append(w.stats, s)
+	w.notes = append(w.notes, f2.Notes...)
+	return nil
+}
+
+// Stats returns the counts of the changed files written so far, ordered by name.
+func (w *StatWriter) Stats() []FileStat {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var stats []FileStat
+	for _, s := range w.stats {
+		if s.Changed {
+			stats = append(stats, s)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// Notes returns the notes of the files written so far.
+func (w *StatWriter) Notes() []Note {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Note(nil), w.notes...)
+}
+
+// List writes the names of the changed files, one per line, like gofmt -l.
+func (w *StatWriter) List(out io.Writer) error {
+	for _, s := range w.Stats() {
+		_, err := fmt.Fprintln(out, s.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Table writes a table of the changed files, with a column of rewrites per rule and a row of totals.
+func (w *StatWriter) Table(out io.Writer) error {
+	stats := w.Stats()
+	if len(stats) == 0 {
+		return nil
+	}
+	totals := map[string]int{}
+	for _, s := range stats {
+		for rule, c := range s.Rules {
+			totals[rule] += c
+		}
+	}
+	rules := make([]string, 0, len(totals))
+	for rule := range totals {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	row := func(name string, counts map[string]int) {
+		total := 0
+		fmt.Fprintf(tw, "%s\t", name)
+		for _, rule := range rules {
+			fmt.Fprintf(tw, "%d\t", counts[rule])
+			total += counts[rule]
+		}
+		fmt.Fprintf(tw, "%d\n", total)
+	}
+	fmt.Fprint(tw, "file\t")
+	for _, rule := range rules {
+		fmt.Fprintf(tw, "%s\t", rule)
+	}
+	fmt.Fprint(tw, "total\n")
+	for _, s := range stats {
+		row(s.Name, s.Rules)
+	}
+	row("total", totals)
+	return tw.Flush()
+}
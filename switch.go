@@ -0,0 +1,243 @@
+package errfix
+
+import (
+	"go/token"
+
+	"github.com/dave/dst"
+)
+
+// hasValueCase returns true when a case of the expression switch n compares with something other than nilName.
+func hasValueCase(n *dst.SwitchStmt, nilName string) bool {
+	for _, stmt := range n.Body.List {
+		clause, ok := stmt.(*dst.CaseClause)
+		if !ok {
+			continue
+		}
+		for _, e := range clause.List {
+			if !isName(e, nilName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *causeRule) fixSwitchStmt(p *Pass, n *dst.SwitchStmt) (changed bool) {
+	// switch err { case ErrNotFound: ... }
+	// ->
+	// switch errors.Cause(err) { case ErrNotFound: ... }
+	if n.Tag == nil || !p.IsErr(n.Tag) || !hasValueCase(n, r.nilIdent) || p.Ignored(n) {
+		return
+	}
+	n.Tag = r.causeExpr(n.Tag)
+	p.Rewrote(n)
+	return true
+}
+
+func (r *isRule) fixSwitchStmt(p *Pass, n *dst.SwitchStmt) (changed bool) {
+	if n.Tag == nil {
+		return
+	}
+	x, ok := n.Tag, false
+	if r.cause {
+		x, ok = causeArg(p, x)
+	} else {
+		ok = p.IsErr(x)
+	}
+	if !ok || !hasValueCase(n, r.nilIdent) || p.Ignored(n) {
+		return
+	}
+	// switch err { case ErrA, ErrB: ... case nil: ... }
+	// ->
+	// switch { case errors.Is(err, ErrA), errors.Is(err, ErrB): ... case err == nil: ... }
+	// Default clauses and fallthrough statements keep their meaning in the tagless switch.
+	for _, stmt := range n.Body.List {
+		clause, ok := stmt.(*dst.CaseClause)
+		if !ok {
+			continue
+		}
+		for i, e := range clause.List {
+			cond := &dst.BinaryExpr{X: dst.Clone(x).(dst.Expr), Op: token.EQL, Y: e}
+			if isName(e, r.nilIdent) {
+				clause.List[i] = cond
+			} else {
+				clause.List[i] = r.isExpr(cond)
+			}
+		}
+	}
+	n.Tag = nil
+	p.Rewrote(n)
+	return true
+}
+
+// fixTypeSwitchStmt rewrites a type switch on an error into a chain of if statements calling errors.As,
+// in the order of the cases, with the default clause last. It returns nil when n is left unchanged.
+func (r *asRule) fixTypeSwitchStmt(p *Pass, n *dst.TypeSwitchStmt) dst.Stmt {
+	var bind string
+	var assert *dst.TypeAssertExpr
+	switch a := n.Assign.(type) {
+	case *dst.AssignStmt:
+		if len(a.Lhs) == 1 && len(a.Rhs) == 1 {
+			id, _ := a.Lhs[0].(*dst.Ident)
+			assert, _ = a.Rhs[0].(*dst.TypeAssertExpr)
+			if id != nil {
+				bind = id.Name
+			}
+		}
+	case *dst.ExprStmt:
+		assert, _ = a.X.(*dst.TypeAssertExpr)
+	}
+	if assert == nil {
+		return nil
+	}
+	x, ok := assert.X, false
+	if r.cause {
+		x, ok = causeArg(p, x)
+	} else {
+		ok = p.IsErr(x)
+	}
+	if !ok {
+		return nil
+	}
+	// The if statements would need the statement of the switch as their own.
+	if n.Init != nil {
+		p.Note(n, "type switch left unchanged: its init statement cannot be moved to errors.As")
+		return nil
+	}
+	var clauses []*dst.CaseClause
+	var def *dst.CaseClause
+	for _, stmt := range n.Body.List {
+		clause := stmt.(*dst.CaseClause)
+		if hasSwitchBreak(clause.Body) {
+			p.Note(n, "type switch left unchanged: break statements would leave the enclosing statement of an if chain")
+			return nil
+		}
+		if clause.List == nil {
+			def = clause
+		} else {
+			clauses = append(clauses, clause)
+		}
+	}
+	if len(clauses) == 0 || p.Ignored(n) {
+		return nil
+	}
+	if bind == "_" {
+		bind = ""
+	}
+
+	// switch e := err.(type) { case *T: ... case *A, *B: ... default: ... }
+	// ->
+	// if e := (*T)(nil); errors.As(err, &e) { ... } else if e := err; errors.As(err, new(*A)) || errors.As(err, new(*B)) { ... } else { ... }
+	var first, last *dst.IfStmt
+	for _, clause := range clauses {
+		ifStmt := &dst.IfStmt{Body: clauseBlock(clause, first != nil)}
+		if len(clause.List) == 1 && !isName(clause.List[0], "nil") {
+			// e has the type of the case.
+			t := clause.List[0]
+			if bind != "" {
+				ifStmt.Init = &dst.AssignStmt{Lhs: []dst.Expr{dst.NewIdent(bind)}, Tok: token.DEFINE, Rhs: []dst.Expr{zeroExpr(t)}}
+				ifStmt.Cond = r.asExpr(dst.Clone(x).(dst.Expr), &dst.UnaryExpr{Op: token.AND, X: dst.NewIdent(bind)})
+			} else {
+				ifStmt.Cond = r.asExpr(dst.Clone(x).(dst.Expr), newExpr(t))
+			}
+		} else {
+			// e has the type of the error.
+			for _, t := range clause.List {
+				var cond dst.Expr
+				if isName(t, "nil") {
+					cond = &dst.BinaryExpr{X: dst.Clone(x).(dst.Expr), Op: token.EQL, Y: t}
+				} else {
+					cond = r.asExpr(dst.Clone(x).(dst.Expr), newExpr(t))
+				}
+				if ifStmt.Cond == nil {
+					ifStmt.Cond = cond
+				} else {
+					ifStmt.Cond = &dst.BinaryExpr{X: ifStmt.Cond, Op: token.LOR, Y: cond}
+				}
+			}
+			if bind != "" && usesName(clause.Body, bind) {
+				ifStmt.Init = &dst.AssignStmt{Lhs: []dst.Expr{dst.NewIdent(bind)}, Tok: token.DEFINE, Rhs: []dst.Expr{dst.Clone(x).(dst.Expr)}}
+			}
+		}
+		if first == nil {
+			first = ifStmt
+		} else {
+			last.Else = ifStmt
+		}
+		last = ifStmt
+	}
+	if def != nil {
+		body := def.Body
+		if bind != "" && usesName(body, bind) {
+			assign := &dst.AssignStmt{Lhs: []dst.Expr{dst.NewIdent(bind)}, Tok: token.DEFINE, Rhs: []dst.Expr{dst.Clone(x).(dst.Expr)}}
+			body = append([]dst.Stmt{assign}, body...)
+		}
+		block := clauseBlock(def, true)
+		block.List = body
+		last.Else = block
+	}
+	first.Decs.Before, first.Decs.After = n.Decs.Before, n.Decs.After
+	first.Decs.Start = append(append(dst.Decorations{}, n.Decs.Start...), clauses[0].Decs.Start...)
+	first.Decs.End = n.Decs.End
+	p.Rewrote(n)
+	return first
+}
+
+// clauseBlock returns the block of the statements of the clause, after the comments of the clause.
+// The comments before the case keyword stay in front of the first if statement of the chain, unless inBlock is true.
+func clauseBlock(clause *dst.CaseClause, inBlock bool) *dst.BlockStmt {
+	block := &dst.BlockStmt{List: clause.Body}
+	if inBlock {
+		block.Decs.Lbrace.Append(clause.Decs.Start...)
+	}
+	block.Decs.Lbrace.Append(clause.Decs.Case...)
+	block.Decs.Lbrace.Append(clause.Decs.Colon...)
+	return block
+}
+
+// zeroExpr returns an expression of the zero value of the type t, that errors.As can take the address of.
+func zeroExpr(t dst.Expr) dst.Expr {
+	if _, ok := t.(*dst.StarExpr); ok {
+		return &dst.CallExpr{Fun: &dst.ParenExpr{X: t}, Args: []dst.Expr{dst.NewIdent("nil")}}
+	}
+	return &dst.StarExpr{X: newExpr(t)}
+}
+
+// newExpr returns new(t).
+func newExpr(t dst.Expr) dst.Expr {
+	return &dst.CallExpr{Fun: dst.NewIdent("new"), Args: []dst.Expr{t}}
+}
+
+// hasSwitchBreak returns true when the statements contain a break statement without label that ends their switch,
+// outside of nested loops, switches, selects and function literals.
+func hasSwitchBreak(stmts []dst.Stmt) bool {
+	found := false
+	for _, stmt := range stmts {
+		dst.Inspect(stmt, func(n dst.Node) bool {
+			switch n := n.(type) {
+			case *dst.ForStmt, *dst.RangeStmt, *dst.SwitchStmt, *dst.TypeSwitchStmt, *dst.SelectStmt, *dst.FuncLit:
+				return false
+			case *dst.BranchStmt:
+				if n.Tok == token.BREAK && n.Label == nil {
+					found = true
+				}
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+// usesName returns true when an identifier of the statements is named name.
+func usesName(stmts []dst.Stmt, name string) bool {
+	found := false
+	for _, stmt := range stmts {
+		dst.Inspect(stmt, func(n dst.Node) bool {
+			if id, ok := n.(*dst.Ident); ok && id.Name == name {
+				found = true
+			}
+			return !found
+		})
+	}
+	return found
+}
@@ -0,0 +1,23 @@
+package analyzer
+
+import (
+	"fmt"
+	"os"
+)
+
+func open(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err // want `wrap returned errors with errors.WithStack \(withstack\)`
+	}
+	return f.Close()
+}
+
+func remove(name string) error {
+	err := os.Remove(name)
+	if err != nil {
+		return fmt.Errorf("remove %s: %v", name, err) // want `convert fmt.Errorf to errors.Wrapf .*\(wrapf\)`
+	}
+	fmt.Println("removed", name)
+	return nil
+}
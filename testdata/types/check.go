@@ -0,0 +1,10 @@
+package types
+
+import (
+	"os"
+)
+
+func check(f *os.File) error {
+	_, lastErr := f.Stat()
+	return lastErr
+}
@@ -0,0 +1,20 @@
+package types
+
+import (
+	"os"
+)
+
+func open(name string) (*os.File, error) {
+	f, dbErr := os.Open(name)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	if e := check(f); e != nil {
+		return nil, e
+	}
+	return f, nil
+}
+
+func describe(err string) string {
+	return err
+}
@@ -0,0 +1,325 @@
+package errfix
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"golang.org/x/tools/go/packages"
+)
+
+// errMatcher returns true when the expression is an error value that the rules should rewrite.
+type errMatcher func(dst.Expr) bool
+
+// defaultErrName matches the names of error variables when no pattern is configured.
+var defaultErrName = regexp.MustCompile(`^err$`)
+
+// nameErrMatcher returns an errMatcher that accepts identifiers whose name matches re.
+func nameErrMatcher(re *regexp.Regexp) errMatcher {
+	return func(n dst.Expr) bool {
+		return !isName(n, "nil") && !isName(n, "_") && isMatchName(n, re)
+	}
+}
+
+// typesErrMatcher returns an errMatcher that accepts identifiers whose static type is the error interface.
+// Values of concrete types implementing error are not accepted,
+// because wrapping them would change the type of the expression.
+// Package-level variables are not accepted either: they are sentinels, which are compared with errors
+// instead of being wrapped or unwrapped, as in ErrX == err.
+// When re is not nil, the name of the identifier must match it as well.
+func typesErrMatcher(dec *decorator.Decorator, info *types.Info, re *regexp.Regexp) errMatcher {
+	errType := types.Universe.Lookup("error").Type()
+	return func(n dst.Expr) bool {
+		id, ok := n.(*dst.Ident)
+		if !ok || (re != nil && !isMatchName(id, re)) {
+			return false
+		}
+		// Nodes created by the rules have no ast counterpart and no type.
+		aid, ok := dec.Ast.Nodes[id].(*ast.Ident)
+		if !ok {
+			return false
+		}
+		if obj := info.ObjectOf(aid); obj != nil && obj.Pkg() != nil && obj.Parent() == obj.Pkg().Scope() {
+			return false
+		}
+		t := info.TypeOf(aid)
+		return t != nil && types.Identical(t, errType)
+	}
+}
+
+// ruleTypes is the rule name of the notes about the failures of type checking.
+const ruleTypes = "types"
+
+// typeChecker type checks the files being processed together with the other files of their package.
+// The packages of a directory are loaded once with the go toolchain from the directory,
+// so that their imports are resolved by its module, and their type information is shared by their files.
+type typeChecker struct {
+	fset *token.FileSet
+	mu   sync.Mutex
+	imp  types.Importer
+	dirs map[string]*loadedDir
+}
+
+type loadedDir struct {
+	mu   sync.Mutex
+	done bool
+	pkgs []*packages.Package
+	err  error
+	// files holds the parsed files of the packages of the directory and their content, by package ID and absolute name.
+	files map[string]*packageFiles
+}
+
+// packageFiles maps the files of a loaded package to their syntax tree and their content on disk.
+type packageFiles struct {
+	once     sync.Once
+	files    map[string]*ast.File
+	contents map[string]string
+}
+
+func newTypeChecker() *typeChecker {
+	fset := token.NewFileSet()
+	return &typeChecker{
+		fset: fset,
+		imp:  importer.ForCompiler(fset, "source", nil),
+		dirs: map[string]*loadedDir{},
+	}
+}
+
+// check parses the content of f and type checks it.
+// It returns the decorated file, the decorator used to map it back to the ast and the type information,
+// with notes for the errors of loading and type checking, which leave the types of some expressions unknown.
+func (c *typeChecker) check(ctx context.Context, f *File) (*dst.File, *decorator.Decorator, *types.Info, []Note, error) {
+	// When the file is not on disk, for example when it is read from stdin,
+	// it can only be checked on its own.
+	var pkg *packages.Package
+	var pf *packageFiles
+	abs, err := filepath.Abs(f.Name)
+	if err == nil && isRegularFile(abs) {
+		dir := filepath.Dir(abs)
+		pkgs, err := c.load(ctx, dir)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		pkg = findPackageByFile(pkgs, abs)
+		if pkg != nil {
+			pf = c.packageFiles(dir, pkg)
+			// The files of a package share its type information, unless their content is not the one on disk.
+			if af := pf.files[abs]; af != nil && pf.contents[abs] == f.Content {
+				df, dec, err := c.decorate(af)
+				// The positions of the loaded package are absolute, while notes name the file as it was given.
+				notes := packageNotes(pkg, abs)
+				for i := range notes {
+					notes[i].Pos.Filename = f.Name
+				}
+				return df, dec, pkg.TypesInfo, notes, err
+			}
+		}
+	}
+
+	af, err := parser.ParseFile(c.fset, f.Name, f.Content, parser.ParseComments)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("error parsing ast, %v", err)
+	}
+	path := af.Name.Name
+	files := []*ast.File{af}
+	imp := types.Importer(importerFunc(c.importPackage))
+	if pkg != nil {
+		path = pkg.PkgPath
+		for _, name := range pkg.CompiledGoFiles {
+			if name != abs && pf.files[name] != nil {
+				files = append(files, pf.files[name])
+			}
+		}
+		// The imports of the package are taken from the loaded package, and the others from source.
+		imported := map[string]*types.Package{}
+		if pkg.Types != nil {
+			for _, ip := range pkg.Types.Imports() {
+				imported[ip.Path()] = ip
+			}
+		}
+		imp = importerFunc(func(path string) (*types.Package, error) {
+			if ip, ok := imported[path]; ok {
+				return ip, nil
+			}
+			return c.importPackage(path)
+		})
+	}
+	info, errs := c.checkFiles(path, files, imp)
+	var notes []Note
+	for _, err := range errs {
+		if te, ok := err.(types.Error); ok && te.Fset.Position(te.Pos).Filename == f.Name {
+			notes = append(notes, typesNote(te.Fset.Position(te.Pos), te.Msg))
+		}
+	}
+	df, dec, err := c.decorate(af)
+	return df, dec, info, notes, err
+}
+
+// packageFiles returns the files of the package pkg of the directory dir, read once for all its files.
+func (c *typeChecker) packageFiles(dir string, pkg *packages.Package) *packageFiles {
+	d := c.dir(dir)
+	d.mu.Lock()
+	pf, ok := d.files[pkg.ID]
+	if !ok {
+		pf = &packageFiles{}
+		d.files[pkg.ID] = pf
+	}
+	d.mu.Unlock()
+
+	pf.once.Do(func() {
+		pf.files, pf.contents = map[string]*ast.File{}, map[string]string{}
+		for _, af := range pkg.Syntax {
+			name := c.fset.File(af.Pos()).Name()
+			content, err := os.ReadFile(name)
+			if err != nil {
+				continue
+			}
+			pf.files[name], pf.contents[name] = af, string(content)
+		}
+	})
+	return pf
+}
+
+// checkFiles type checks the files of the package path, and returns the type information collected.
+// The type errors are returned as well, after as much information as possible is collected.
+func (c *typeChecker) checkFiles(path string, files []*ast.File, imp types.Importer) (*types.Info, []error) {
+	info := &types.Info{
+		Types: map[ast.Expr]types.TypeAndValue{},
+		Defs:  map[*ast.Ident]types.Object{},
+		Uses:  map[*ast.Ident]types.Object{},
+	}
+	var errs []error
+	conf := &types.Config{
+		Importer: imp,
+		Error:    func(err error) { errs = append(errs, err) },
+	}
+	_, _ = conf.Check(path, c.fset, files, info)
+	return info, errs
+}
+
+// decorate returns the decorated file of af, with the decorator used.
+func (c *typeChecker) decorate(af *ast.File) (*dst.File, *decorator.Decorator, error) {
+	dec := decorator.NewDecorator(c.fset)
+	df, err := dec.DecorateFile(af)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decorating ast, %v", err)
+	}
+	return df, dec, nil
+}
+
+// importPackage imports a package from source. The source importer is not safe for concurrent use.
+func (c *typeChecker) importPackage(path string) (*types.Package, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.imp.Import(path)
+}
+
+// load returns the packages, including test variants, of the directory dir, with their syntax and type information.
+// A directory that does not exist has no packages.
+func (c *typeChecker) load(ctx context.Context, dir string) ([]*packages.Package, error) {
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil, nil
+	}
+
+	d := c.dir(dir)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.done {
+		cfg := &packages.Config{
+			Context: ctx,
+			Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+				packages.NeedImports | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedSyntax,
+			Dir:   dir,
+			Fset:  c.fset,
+			Tests: true,
+		}
+		pkgs, err := packages.Load(cfg, ".")
+		// The failures that follow from the context of the file are not kept for the other files of the directory.
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			err = fmt.Errorf("error loading package information of %s, %v", dir, err)
+		}
+		d.pkgs, d.err, d.done = pkgs, err, true
+	}
+	return d.pkgs, d.err
+}
+
+// packageNotes returns the notes of the errors of loading the package pkg that concern its file name:
+// the type errors of the file, and the other errors, such as the failures to list or parse the package.
+func packageNotes(pkg *packages.Package, name string) []Note {
+	var notes []Note
+	for _, err := range pkg.Errors {
+		if err.Kind == packages.TypeError {
+			continue
+		}
+		msg := err.Msg
+		if err.Pos != "" {
+			msg = err.Pos + ": " + msg
+		}
+		notes = append(notes, typesNote(token.Position{Filename: name}, msg))
+	}
+	for _, te := range pkg.TypeErrors {
+		if pos := te.Fset.Position(te.Pos); pos.Filename == name {
+			notes = append(notes, typesNote(pos, te.Msg))
+		}
+	}
+	return notes
+}
+
+// typesNote returns the note of an error of type checking at pos.
+func typesNote(pos token.Position, msg string) Note {
+	return Note{Pos: pos, Rule: ruleTypes, Message: "type checking failed, errors of unknown types are left unchanged: " + msg}
+}
+
+// dir returns the state of the directory dir, shared by its files.
+func (c *typeChecker) dir(dir string) *loadedDir {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.dirs[dir]
+	if !ok {
+		d = &loadedDir{files: map[string]*packageFiles{}}
+		c.dirs[dir] = d
+	}
+	return d
+}
+
+// isRegularFile returns true when name is a regular file, unlike a device such as /dev/stdin or a missing file.
+func isRegularFile(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// findPackageByFile returns the package that compiles the file p, preferring the package over its test variants.
+// It returns nil when no package contains the file.
+func findPackageByFile(pkgs []*packages.Package, p string) *packages.Package {
+	var found *packages.Package
+	for _, pkg := range pkgs {
+		for _, name := range pkg.CompiledGoFiles {
+			if name != p {
+				continue
+			}
+			if found == nil || pkg.ID == pkg.PkgPath {
+				found = pkg
+			}
+		}
+	}
+	return found
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}